@@ -18,16 +18,52 @@ const (
 ** to this one BPlusTree object.
 */
 type BPlusTree struct {
-  Pager *pPager           /* The page cache */
-  MemPage *page           /* First page of the database */
-  uint16 maxLocal         /* Maximum local payload in non-LEAFDATA tables */
-  uint16 minLocal         /* Minimum local payload in non-LEAFDATA tables */
-  uint16 maxLeaf          /* Maximum local payload in a LEAFDATA table */
-  uint16 minLeaf          /* Minimum local payload in a LEAFDATA table */
-  uint32 pageSize         /* Total number of bytes on a page */
-  uint32 usableSize       /* Number of usable bytes on each page */
-  uint32 nPage            /* Number of pages in the database */
-  hm map[uint32]*MemPage  /* map pageno to MemPage */
+  Pager *Pager              /* Reads/writes pages through the OS, see pager.go */
+  MemPage *MemPage          /* Root page of the database */
+  maxLocal uint16           /* Maximum local payload in non-LEAFDATA tables */
+  minLocal uint16           /* Minimum local payload in non-LEAFDATA tables */
+  maxLeaf uint16            /* Maximum local payload in a LEAFDATA table */
+  minLeaf uint16            /* Minimum local payload in a LEAFDATA table */
+  pageSize uint32           /* Total number of bytes on a page */
+  usableSize uint32         /* Number of usable bytes on each page */
+  nPage uint32              /* Number of pages in the database */
+  hm map[uint32]*MemPage    /* map pageno to MemPage */
+  catalogPath string        /* Sibling file recording the page map; see saveCatalog/loadCatalog */
+}
+
+/*
+** Open opens path, attaching a PageCache provider registered under
+** cacheBackend ("memory" and "lru2" are registered by default, see
+** pcache.go) and a Pager in the given JournalMode. Callers that need a
+** custom eviction policy register their own provider with Register()
+** before calling Open.
+**
+** If path already holds a database committed by a previous Open, Open
+** rebuilds bt.hm and bt.MemPage from the catalog saveCatalog wrote
+** alongside it (see loadCatalog) instead of returning an empty tree.
+*/
+func Open(path string, cacheBackend string, pageSize int, mode JournalMode) (*BPlusTree, error) {
+  pgr, err := OpenPager(path, pageSize, cacheBackend, mode)
+  if err != nil {
+    return nil, err
+  }
+
+  usable := uint32(pageSize)
+  bptree := &BPlusTree{
+    Pager:      pgr,
+    pageSize:   usable,
+    usableSize: usable,
+    maxLocal:   uint16((usable - 12) * 64 / 255),
+    minLocal:   uint16((usable - 12) * 32 / 255),
+    maxLeaf:    uint16(usable - 35),
+    minLeaf:    uint16((usable - 12) * 32 / 255),
+    hm:         make(map[uint32]*MemPage),
+    catalogPath: path + "-catalog",
+  }
+  if err := bptree.loadCatalog(); err != nil {
+    return nil, err
+  }
+  return bptree, nil
 }
 
 /* Each btree pages is divided into three sections:  The header, the
@@ -64,17 +100,19 @@ type PageHeader struct {
   flag uint8
   freeOffset uint16
   nCell uint16
-  pgno uint16
+  pgno uint32
   nFree uint8
   parent uint32
 }
 
 type MemPage struct{
   ph *PageHeader
+  pgHdr *PgHdr                  /* Backing page in the Pager's cache; see newPage */
   aData unsafe.Pointer          /* Pointer to disk image of the page data */
   aDataEnd unsafe.Pointer       /* One byte past the end of usable data */
   cell unsafe.Pointer       /* The cell index area */
   aDataOfst unsafe.Pointer      /* Same as aData for leaves.  aData+4 for interior */
+  pBt *BPlusTree                /* BPlusTree this page belongs to */
 }
 
 
@@ -97,114 +135,372 @@ type Cell struct {
  */
 type Payload struct {
   key     uint32             /* value in the unpacked key */
-  size    uint16             /* Number of values.  Might be zero */
-  entrys  unsafe.Pointer            /* fot data compress */
+  size    uint16             /* Number of bytes in entrys */
+  entrys  unsafe.Pointer     /* fot data compress */
 }
 
-func (bptree *BPlusTree) Insert(pl *PlayLoad) {
-  offset, pg := Search(pl.key)
-  if offset != nil {
-    return
+/* payloadBytes views pl.entrys as the pl.size raw bytes writePayload
+** needs -- the bridge between the caller's posting-list pointer and the
+** byte-oriented overflow.go helpers. */
+func payloadBytes(pl *Payload) []byte {
+  if pl.size == 0 {
+    return nil
   }
+  return unsafe.Slice((*byte)(pl.entrys), int(pl.size))
+}
 
-  ok, key, newpg := insert(pl, pg)
-  if ok != nil {
-    return
+/*
+** newPage allocates a fresh page of the given flag (LEAFPAGE or
+** INTERPAGE) through bt.Pager, wraps it in a MemPage backed by that
+** page's real buffer, and registers it in bt.hm so later lookups by
+** pgno find it. AllocatePage hands the page back already Unpinned, so
+** newPage re-Fetches it to take its own reference for as long as it
+** stays resident in bt.hm -- see BPlusTree.commit, which is what keeps
+** that reference from tripping Pager.Commit's AssertNoRefs.
+*/
+func (bt *BPlusTree) newPage(flag uint8) (*MemPage, error) {
+  pgno, _, err := bt.Pager.AllocatePage()
+  if err != nil {
+    return nil, err
+  }
+  pgHdr, err := bt.Pager.ReadPage(pgno)
+  if err != nil {
+    return nil, err
   }
 
-  ppg := bptree.hm[pg.parent()]
+  maxCells := int(bt.usableSize) / int(unsafe.Sizeof(Cell{}))
+  cells := make([]Cell, maxCells)
+  data := unsafe.Slice(pgHdr.pBuf, int(bt.usableSize))
 
-  for {
-    ok, key, newpg = insert(&Cell{key: key,ptr: newpg.ph.phno}, ppg)
-    if ok != nil {
-      return
-    }
+  pg := &MemPage{
+    ph:    &PageHeader{flag: flag, pgno: pgno},
+    pgHdr: pgHdr,
+    aData: unsafe.Pointer(&data[0]),
+    cell:  unsafe.Pointer(&cells[0]),
+    pBt:   bt,
+  }
+  bt.hm[pgno] = pg
+  bt.nPage++
+  return pg, nil
+}
+
+/* headerSize is 12 bytes for an interior page (room for the trailing
+** Ptr(N) child) and 8 for a leaf, matching the PageHeader layout above. */
+func (pg *MemPage) headerSize() int {
+  if pg.ph.flag == INTERPAGE {
+    return 12
+  }
+  return 8
+}
+
+/* contentCapacity is the number of content-area bytes available to
+** cells on pg once the header is accounted for. The cell pointer array
+** itself (pg.cell, see maxCells in cursor.go) is a separate, in-memory
+** Go slice rather than bytes carved out of aData, so it doesn't compete
+** with payloads for content-area space. */
+func (pg *MemPage) contentCapacity() int {
+  return int(pg.pBt.usableSize) - pg.headerSize()
+}
+
+/* spaceNeeded is the number of content-area bytes a payload of
+** payloadLen bytes will occupy: the whole thing if it fits within
+** maxLeaf, otherwise just the locally-kept minLeaf prefix (see
+** writePayload in overflow.go for where the remainder goes). */
+func (bt *BPlusTree) spaceNeeded(payloadLen int) int {
+  local := payloadLen
+  if local > int(bt.maxLeaf) {
+    local = int(bt.minLeaf)
+  }
+  return payloadHdrSize + local
+}
+
+/* full reports whether pg has room left for need more content-area
+** bytes. Interior pages never bump freeOffset -- insertInterior's cells
+** are fixed-size and go straight into the cell pointer array -- so they
+** use a distinct measure: the number of cells need represents against
+** pg.maxCells(), rather than the leaf byte-capacity check. */
+func (pg *MemPage) full(need int) bool {
+  if pg.ph.flag == INTERPAGE {
+    cellsNeeded := need / int(unsafe.Sizeof(Cell{}))
+    return int(pg.ph.nCell)+cellsNeeded > pg.maxCells()
+  }
+  return int(pg.ph.freeOffset)+need > pg.contentCapacity()
+}
 
-    if ppg.ph.pgno == bptree.page.pgno {
-      // alloc new root page for bplustree and update bplustree page
-      rootpage := &MemPage{}
-      bptree.page = rootpage
-      // insert new page cell
-      _, _, _ := insert(&Cell{key: key,ptr: newpg.ph.phno}, rootpage)
+/* allocSpace bump-allocates need bytes from pg's content area and
+** returns the offset cells()[i].ptr should record to find them again. */
+func (pg *MemPage) allocSpace(need int) int {
+  off := int(pg.ph.freeOffset)
+  pg.ph.freeOffset += uint16(need)
+  return off
+}
 
-      // insert origin page cell
-      _, _, _ := insert(&Cell{key: key,ptr: ppg.ph.phno}, rootpage)
-      return
+/*
+** Insert adds pl to the tree under its own pager transaction, splitting
+** pages up the root-to-leaf path as needed. It is a no-op if pl.key
+** already exists.
+*/
+func (bt *BPlusTree) Insert(pl *Payload) error {
+  if bt.MemPage == nil {
+    root, err := bt.newPage(LEAFPAGE)
+    if err != nil {
+      return err
     }
-    ppg = bptree.hm[ppg.parent()]
-  }
-}
-
-func (bptree *BPlusTree) Search(key int) (uint16, *MemPage) {
-  curr := bptree.pPage
-  for {
-    switch t := curr.ph.flag {
-    case LEAFPAGE:
-      offset, ok := find(curr, key)
-      if !ok {
-        return nil, curr
-      }
-      return offset, curr
-    case INTERPAGE:
-      pgno, _ := find(key)
-      curr = bptree.hm[pgno]
-      // pager should load page and cached
-    default:
-      panic("no such flag!")
+    bt.MemPage = root
+  }
+
+  if err := bt.Pager.Begin(); err != nil {
+    return err
+  }
+
+  c := NewCursor(bt)
+  found, err := c.Seek(int(pl.key))
+  if err != nil {
+    bt.Pager.Rollback()
+    return err
+  }
+  if found {
+    return bt.Pager.Rollback()
+  }
+
+  if err := bt.insertAt(c, pl); err != nil {
+    bt.Pager.Rollback()
+    return err
+  }
+  if err := bt.commit(); err != nil {
+    return err
+  }
+  return bt.saveCatalog()
+}
+
+/*
+** commit flushes the transaction through Pager.Commit. Every MemPage
+** resident in bt.hm holds a reference on its backing PgHdr for as long
+** as it stays there (see newPage/loadCatalog), so an unrelated Fetch
+** elsewhere can't silently recycle the buffer out from under the tree.
+** Pager.Commit's AssertNoRefs expects zero outstanding references,
+** though, so that reference has to come off right before the commit
+** and go back on right after, or every commit would panic.
+*/
+func (bt *BPlusTree) commit() error {
+  for _, pg := range bt.hm {
+    bt.Pager.cache.Unpin(pg.pgHdr, true)
+  }
+
+  err := bt.Pager.Commit()
+
+  for _, pg := range bt.hm {
+    if _, rerr := bt.Pager.ReadPage(uint32(pg.ph.pgno)); rerr != nil && err == nil {
+      err = rerr
     }
   }
+  return err
 }
 
-func (p *MemPage) insert(data interface{}) (bool, uint32, *MemPage){
-  ok := p.full(data)
-  if !ok {
-    return true, nil, nil
+/* insertAt does the actual cell/payload insertion at the leaf c is
+** positioned on, propagating a split up through every ancestor frame in
+** c.stack and, if the root itself splits, growing the tree by one
+** level. Every interior cell's key must equal the largest key reachable
+** through that cell's child (seekCell's ceiling search relies on it), so
+** each step up re-derives the split pair's keys from maxKey rather than
+** reusing splitLeaf/splitInterior's bubbled-up separator, which is the
+** new sibling's smallest key, not its largest. */
+func (bt *BPlusTree) insertAt(c *Cursor, pl *Payload) error {
+  leaf := c.stack[len(c.stack)-1]
+  data := payloadBytes(pl)
+  need := bt.spaceNeeded(len(data))
+
+  var sibling *MemPage
+  var err error
+  if leaf.pg.full(need) {
+    _, sibling, err = leaf.pg.splitLeaf(leaf.idx, pl)
+  } else {
+    off := leaf.pg.allocSpace(need)
+    leaf.pg.insertCellAt(leaf.idx, Cell{key: pl.key, ptr: uint32(off)})
+    err = writePayload(leaf.pg, leaf.idx, data)
+  }
+  if err != nil {
+    return err
+  }
+  if err := bt.Pager.WritePage(leaf.pg.pgHdr); err != nil {
+    return err
+  }
+  if sibling != nil {
+    if err := bt.Pager.WritePage(sibling.pgHdr); err != nil {
+      return err
+    }
+  }
+  if sibling == nil {
+    return nil
   }
 
-  //key, newpg :=split(pg)
-  newpg := newpage()
-  //update page info
+  child := sibling
+  leftMax := leaf.pg.maxKey()
+  rightMax := sibling.maxKey()
+  for level := len(c.stack) - 2; level >= 0; level-- {
+    frame := c.stack[level]
+    frame.pg.cells()[frame.idx].key = leftMax
+
+    var parentSibling *MemPage
+    _, parentSibling, err = frame.pg.insertInterior(frame.idx+1, rightMax, child)
+    if err != nil {
+      return err
+    }
+    if err := bt.Pager.WritePage(frame.pg.pgHdr); err != nil {
+      return err
+    }
+    if parentSibling == nil {
+      return nil
+    }
+    if err := bt.Pager.WritePage(parentSibling.pgHdr); err != nil {
+      return err
+    }
+    child = parentSibling
+    leftMax = frame.pg.maxKey()
+    rightMax = parentSibling.maxKey()
+  }
 
-  return false, key, newpg
+  /* Every ancestor absorbed its split except the root: grow the tree by
+  ** one level with a fresh root pointing at the old root and its new
+  ** sibling. */
+  newRoot, err := bt.newPage(INTERPAGE)
+  if err != nil {
+    return err
+  }
+  oldRoot := bt.MemPage
+  newRoot.appendCell(Cell{key: leftMax, ptr: uint32(oldRoot.ph.pgno)})
+  newRoot.appendCell(Cell{key: rightMax, ptr: uint32(child.ph.pgno)})
+  bt.MemPage = newRoot
+  return bt.Pager.WritePage(newRoot.pgHdr)
 }
 
-func (p *MemPage) find(key int) (int, bool) {
-  cmp := func (i int) bool {
-    return p.cell[i].key >= key
+/*
+** splitLeaf makes room for pl on a full leaf pg by allocating a new
+** leaf sibling and dividing every existing payload (plus pl itself)
+** between the two in sorted order. Payloads are read back out via
+** readPayload and rewritten with writePayload rather than copied as
+** raw bytes, since a cell's ptr offset is only meaningful within the
+** page it was allocated on.
+*/
+func (pg *MemPage) splitLeaf(idx int, pl *Payload) (uint32, *MemPage, error) {
+  bt := pg.pBt
+  right, err := bt.newPage(LEAFPAGE)
+  if err != nil {
+    return 0, nil, err
   }
 
-  i := sort.Search(p.ph.nCell, cmp)
+  n := int(pg.ph.nCell)
+  oldCells := append([]Cell{}, pg.cells()...)
+  oldData := make([][]byte, n)
+  for i := 0; i < n; i++ {
+    if oldData[i], err = readPayload(pg, i); err != nil {
+      return 0, nil, err
+    }
+  }
 
-  if p.ph.flag == INTERPAGE {
-    return p.cell[i].ptr, true
+  type entry struct {
+    key  uint32
+    data []byte
+  }
+  all := make([]entry, 0, n+1)
+  all = append(all, make([]entry, n)...)
+  for i, c := range oldCells {
+    all[i] = entry{key: c.key, data: oldData[i]}
   }
+  newEntry := entry{key: pl.key, data: payloadBytes(pl)}
+  all = append(all[:idx], append([]entry{newEntry}, all[idx:]...)...)
 
-  if i <= p.ph.nCell && p.cell[i].key == key {
-    return p.cell[i].ptr, true
+  mid := len(all) / 2
+  pg.ph.nCell = 0
+  pg.ph.freeOffset = 0
+  right.ph.nCell = 0
+  right.ph.freeOffset = 0
+
+  for i, e := range all {
+    dest := pg
+    if i >= mid {
+      dest = right
+    }
+    destIdx := int(dest.ph.nCell)
+    off := dest.allocSpace(bt.spaceNeeded(len(e.data)))
+    dest.appendCell(Cell{key: e.key, ptr: uint32(off)})
+    if err := writePayload(dest, destIdx, e.data); err != nil {
+      return 0, nil, err
+    }
   }
 
-  return nil, false
+  return right.cells()[0].key, right, nil
 }
 
-func (p *MemPage) parent() uint32 {
-  return p.ph.pgno
+/*
+** insertInterior adds a (key, child) cell to interior page pg at idx,
+** splitting pg first if it has no room left.
+*/
+func (pg *MemPage) insertInterior(idx int, key uint32, child *MemPage) (uint32, *MemPage, error) {
+  need := int(unsafe.Sizeof(Cell{}))
+  if pg.full(need) {
+    return pg.splitInterior(idx, key, child)
+  }
+  pg.insertCellAt(idx, Cell{key: key, ptr: uint32(child.ph.pgno)})
+  return 0, nil, nil
 }
 
-func (p *MemPage) setparent(uint32 pgno) {
-  p.ph.parent = pgno
+/*
+** splitInterior divides a full interior page pg (plus the incoming
+** cell) into pg and a new right sibling. Every cell stays on one side or
+** the other -- an interior page's N cells describe N children -- and the
+** right sibling's smallest key is returned as the separator.
+*/
+func (pg *MemPage) splitInterior(idx int, key uint32, child *MemPage) (uint32, *MemPage, error) {
+  bt := pg.pBt
+  right, err := bt.newPage(INTERPAGE)
+  if err != nil {
+    return 0, nil, err
+  }
+
+  cells := append([]Cell{}, pg.cells()...)
+  newCell := Cell{key: key, ptr: uint32(child.ph.pgno)}
+  cells = append(cells[:idx], append([]Cell{newCell}, cells[idx:]...)...)
+
+  /* Unlike a leaf split, cells[mid] isn't a separator to discard -- every
+  ** interior cell's ptr is a live child, keyed by that child's own
+  ** maxKey (see insertAt's comment on the ceiling-key invariant). It
+  ** stays with pg so its child isn't orphaned. */
+  mid := len(cells) / 2
+
+  pg.ph.nCell = uint16(mid + 1)
+  copy(pg.allCells(), cells[:mid+1])
+
+  right.ph.nCell = uint16(len(cells) - mid - 1)
+  copy(right.allCells(), cells[mid+1:])
+
+  return right.cells()[0].key, right, nil
 }
 
-func (p *MemPage) full(data interface{}) bool {
-  switch data.(type){
-  case *Cell:
-    if p.ph.flag == INTERPAGE {
-      return p.ph.nFree > (pl.size + size(Cell))
-    }
-    panic("full error")
-  case *PlayLoad:
-    if p.ph.flag == LEAFPAGE {
-      return p.ph.nFree > (pl.size + size(Cell))
-    }
-    panic("full error")
+/*
+** Search returns the page and in-page cell index of the smallest key
+** >= key, along with whether key itself is present. It is a thin
+** wrapper over Cursor.Seek for callers that want a single lookup
+** without keeping a Cursor around.
+*/
+func (bt *BPlusTree) Search(key int) (*MemPage, int, bool, error) {
+  c := NewCursor(bt)
+  found, err := c.Seek(key)
+  if err != nil {
+    return nil, 0, false, err
+  }
+  if len(c.stack) == 0 {
+    return nil, 0, false, nil
   }
+  top := c.top()
+  return top.pg, top.idx, found, nil
+}
+
+/* parent returns the pgno of p's parent page, 0 for the root. */
+func (p *MemPage) parent() uint32 {
+  return p.ph.parent
+}
+
+func (p *MemPage) setparent(pgno uint32) {
+  p.ph.parent = pgno
 }
@@ -0,0 +1,141 @@
+package bplustree
+
+import (
+  "testing"
+  "unsafe"
+)
+
+/*
+** Open must rebuild bt.MemPage/bt.hm from whatever a previous Open
+** already committed to path, not start over with an empty tree: a key
+** inserted and committed before close must still be found by a Cursor
+** after a fresh Open of the same path.
+*/
+func TestOpenRebuildsTreeFromDisk(t *testing.T) {
+  path := t.TempDir() + "/test.db"
+
+  bt1, err := Open(path, "memory", 4096, JournalRollback)
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+  for i := uint32(0); i < 20; i++ {
+    data := []byte{byte(i)}
+    pl := &Payload{key: i, size: uint16(len(data)), entrys: unsafe.Pointer(&data[0])}
+    if err := bt1.Insert(pl); err != nil {
+      t.Fatalf("Insert(%d): %v", i, err)
+    }
+  }
+
+  bt2, err := Open(path, "memory", 4096, JournalRollback)
+  if err != nil {
+    t.Fatalf("re-Open: %v", err)
+  }
+  if bt2.MemPage == nil {
+    t.Fatal("re-Open left MemPage nil; nothing was read back from disk")
+  }
+
+  c := NewCursor(bt2)
+  for i := uint32(0); i < 20; i++ {
+    found, err := c.Seek(int(i))
+    if err != nil {
+      t.Fatalf("Seek(%d): %v", i, err)
+    }
+    if !found {
+      t.Fatalf("Seek(%d) after re-Open: key not found", i)
+    }
+    got, err := c.Value()
+    if err != nil {
+      t.Fatalf("Value(%d): %v", i, err)
+    }
+    if len(got) != 1 || got[0] != byte(i) {
+      t.Fatalf("Value(%d) = %v, want [%d]", i, got, byte(i))
+    }
+  }
+}
+
+/*
+** A resident MemPage must survive a cache_size small enough that an
+** unrelated Fetch would otherwise want to recycle its PgHdr: bt.hm
+** holding the only Go-level reference to a page is not enough, since
+** AllocatePage itself drops the cache's own reference on every page it
+** hands out (see newPage). Between transactions every bt.hm page is
+** clean and pinned by that reference, so an unrelated Fetch -- one that
+** has nothing to do with the tree, made directly against bt.Pager the
+** way a sibling connection sharing the same cache would -- must fall
+** back to allocating a fresh buffer rather than recycling one of them.
+*/
+func TestResidentPageSurvivesCacheSizeRecycling(t *testing.T) {
+  path := t.TempDir() + "/test.db"
+  bt, err := Open(path, "memory", 128, JournalRollback)
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+
+  for i := uint32(0); i < 20; i++ {
+    data := []byte{byte(i)}
+    pl := &Payload{key: i, size: uint16(len(data)), entrys: unsafe.Pointer(&data[0])}
+    if err := bt.Insert(pl); err != nil {
+      t.Fatalf("Insert(%d): %v", i, err)
+    }
+  }
+
+  bt.Pager.cache.SetCacheSize(1)
+  for pgno := uint32(1000); pgno < 1010; pgno++ {
+    if _, err := bt.Pager.ReadPage(pgno); err != nil {
+      t.Fatalf("unrelated ReadPage(%d): %v", pgno, err)
+    }
+  }
+
+  c := NewCursor(bt)
+  for i := uint32(0); i < 20; i++ {
+    found, err := c.Seek(int(i))
+    if err != nil {
+      t.Fatalf("Seek(%d): %v", i, err)
+    }
+    if !found {
+      t.Fatalf("Seek(%d): key not found after unrelated cache pressure", i)
+    }
+    got, err := c.Value()
+    if err != nil {
+      t.Fatalf("Value(%d): %v", i, err)
+    }
+    if len(got) != 1 || got[0] != byte(i) {
+      t.Fatalf("Value(%d) = %v, want [%d]; a resident page was recycled out from under the tree", i, got, byte(i))
+    }
+  }
+}
+
+/*
+** full() must measure an interior page's cell count against maxCells,
+** not freeOffset -- insertInterior never advances freeOffset, so the
+** leaf byte-capacity check never trips and insertCellAt runs past the
+** page's real capacity. Enough sequential inserts at a small pageSize
+** drive several levels of interior splits, and every key inserted
+** along the way -- including ones that land on now-former root pages
+** displaced by a split -- must stay reachable afterward.
+*/
+func TestInteriorSplitKeepsAllKeysReachable(t *testing.T) {
+  path := t.TempDir() + "/test.db"
+  bt, err := Open(path, "memory", 128, JournalRollback)
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+
+  const n = 2000
+  for i := uint32(0); i < n; i++ {
+    if err := bt.Insert(&Payload{key: i}); err != nil {
+      t.Fatalf("Insert(%d): %v", i, err)
+    }
+  }
+
+  c := NewCursor(bt)
+  for i := uint32(0); i < n; i++ {
+    found, err := c.Seek(int(i))
+    if err != nil {
+      t.Fatalf("Seek(%d): %v", i, err)
+    }
+    if !found {
+      t.Fatalf("Seek(%d): key not found after interior splits", i)
+    }
+  }
+}
@@ -18,7 +18,6 @@ package bplustree
 
 import (
   "unsafe"
-  "C"
 )
 
 /* Allowed values for second argument to ManageDirtyList() */
@@ -28,12 +27,30 @@ const (
   PCACHE_DIRTYLIST_FRONT   = 3    /* Move pPage to the front of the list */
 )
 
+/* Bits for PgHdr.flags */
+const (
+  PGHDR_CLEAN      = 0x01  /* Page not dirty. Page and its content are clean */
+  PGHDR_DIRTY      = 0x02  /* Page has changed. The content is not clean */
+  PGHDR_WRITEABLE  = 0x04  /* Page is a writeable copy */
+  PGHDR_NEED_SYNC  = 0x08  /* Fsync the rollback journal before writing this page */
+)
+
 type PCache struct {
   szPage int                         /* Size of database content section */
   szAlloc int                     /* Total size of one pcache line */
   nMin int                  /* Minimum number of pages reserved */
   nMax int                  /* Configured "cache_size" value */
+  nPurgeable int            /* Number of purgeable (unpinned) pages, for PGroup steal accounting */
+  nRefSum int               /* Sum of nRef over every page in this cache */
+  pGroup *PGroup            /* Group this cache belongs to, shared with sibling caches */
   pBulk *byte
+  pFree *PgHdr              /* Free list built by InitBulk/FreePage */
+  iMaxKey int               /* Largest key ever Fetch()ed */
+
+  pDirty *PgHdr             /* List of dirty pages, newest first */
+  pDirtyTail *PgHdr         /* Last (oldest) page in the pDirty list */
+  pSynced *PgHdr            /* Last synced page in the pDirty list, walked by xStress */
+  xStress func(*PgHdr) error /* Called by Fetch to write a dirty victim out and make it clean */
 
   /* Hash table of all pages. The following variables may only be accessed
   ** when the accessor is holding the PGroup mutex.
@@ -41,9 +58,7 @@ type PCache struct {
   nPage int                 /* Total number of pages in apHash */
   nInitPage int
   nHash int                /* Number of slots in apHash[] */
-  apHash **PgHdr                    /* Hash table for fast lookup by key */
-  pNext *PgHdr                     /* Next in hash table chain */
-  iKey int                  /* Key value (page number) */
+  apHash []*PgHdr                   /* Hash table for fast lookup by key */
 }
 
 /*
@@ -60,13 +75,15 @@ type PgHdr struct {
   pBuf *byte                   /* Page data */
   pExtra *byte                  /* Extra content */
   pCache *PCache              /* PRIVATE: Cache that owns this page */
-  pDirty *PgHdr                 /* Transient list of dirty sorted by pgno */
+  pNext *PgHdr                  /* Next page in this PCache's hash chain */
   pPager *PgHdr                  /* The pager this page is part of */
   iKey int                     /* Page number for this page */
   pDirtyNext *PgHdr             /* Next element in list of dirty pages */
   pDirtyPrev *PgHdr             /* Previous element in list of dirty pages */
   pLruNext *PgHdr             /* Next in LRU list of unpinned pages */
   pLruPrev *PgHdr              /* Previous in LRU list of unpinned pages */
+  flags uint16                /* PGHDR_DIRTY, PGHDR_CLEAN, etc. See above */
+  nRef int                    /* Number of outstanding references, see Ref/Unref */
 }
 
 /*
@@ -76,40 +93,35 @@ type PgHdr struct {
 */
 func (pCache *PCache) Create(szPage int) {
   pCache.szPage = szPage
-  pCache.szAlloc = szPage + int(unsafe.Sizeof(&PgHdr{}))
-  // pcache1EnterMutex(pGroup);
-  pCache.ResizeHash()
-  // pcache1LeaveMutex(pGroup);
-  if( pCache.nHash==0 ){
-    pCache.Destroy()
+  pCache.szAlloc = szPage + int(unsafe.Sizeof(PgHdr{}))
+  if pCache.pGroup == nil {
+    /* No group assigned (e.g. no sibling caches) -- a cache always needs
+    ** somewhere to keep its LRU list, so give it one of its own. */
+    NewPGroup().Attach(pCache)
   }
+  pCache.pGroup.mu.Lock()
+  pCache.ResizeHash()
+  pCache.pGroup.mu.Unlock()
   pCache.InitBulk()
 }
 
 /*
-** Try to initialize the pCache.pFree and pCache.pBulk fields.  Return
-** true if pCache.pFree ends up containing one or more free pages.
+** InitBulk preallocates a pool of bare PgHdr structs onto pCache.pFree
+** so that the common case -- Fetch needing a fresh page -- does not pay
+** for an allocation on every call. Deliberately left without a content
+** buffer: pBuf==nil is how Pager.ReadPage (pager.go) recognizes a page
+** that still needs its disk image read and its flags initialized.
 */
-func (pCache *PCache) InitBulk() *[]byte {
-  /* Do not bother with a bulk allocation if the cache size very small */
-  var szBulk int
-  if pCache.nInitPage>0 {
-    szBulk = pCache.szAlloc * pCache.nInitPage
-  } else {
-    szBulk = pCache.szAlloc * 1024
-  }
-  pBulk := (*byte)(unsafe.Pointer(C.malloc()))//make([]byte, szBulk)
-  pCache.pBulk = pBulk
-
-  nBulk := szBulk/pCache.szAlloc
-  for i:= 0; i < nBulk; i++ {
-    pX := (*PgHdr)(unsafe.Pointer(&pBulk[i*pCache.szAlloc]))
-    pX.pBuf = pBulk
-    pX.pNext = pCache.pFree
-    pCache.pFree = pX
-    pBulk += pCache.szAlloc
-  }
-  return pCache.pFree
+func (pCache *PCache) InitBulk() {
+  n := pCache.nInitPage
+  if n <= 0 {
+    n = 1024
+  }
+  for i := 0; i < n; i++ {
+    pg := &PgHdr{}
+    pg.pNext = pCache.pFree
+    pCache.pFree = pg
+  }
 }
 
 
@@ -119,84 +131,109 @@ func (pCache *PCache) InitBulk() *[]byte {
 ** Destroy a cache allocated using Create().
 */
 func (pCache *PCache) Destroy(){
-  // if( pCache.nPage ) pcache1TruncateUnsafe(pCache, 0);
-  // free(pCache.apHash);
-  // free(pBulk)
-  // free(pCache);
+  pCache.apHash = nil
+  pCache.pFree = nil
+  pCache.pBulk = nil
 }
 
-func (pCache *PCache) FetchPage(iKey int) *PgHdr {
+func (pCache *PCache) Fetch(iKey int) *PgHdr {
 
   /* Step 1: Search the hash table for an existing entry. */
-  pPage := pCache.apHash[iKey % pCache.nHash];
-  for pPage && pPage.iKey!=iKey {
-    pPage = pPage.pNext;
+  var pPage *PgHdr
+  if pCache.nHash > 0 {
+    pPage = pCache.apHash[iKey % pCache.nHash]
+  }
+  for pPage != nil && pPage.iKey != iKey {
+    pPage = pPage.pNext
   }
 
   /* Step 2: If the page was found in the hash table, then return it.
   ** If the page was not in the hash table continue with
   ** subsequent steps to try to create the page. */
   if pPage != nil {
+      pCache.Ref(pPage)
       return pPage
   }
   /* Steps 3 if page num is nearly full resize the hash*/
-  if pCache.nPage>=pCache.nHash {
+  if pCache.nPage >= pCache.nHash {
     pCache.ResizeHash()
   }
-  /* Step 4. Try to recycle a page. */
-  if pCache.nPage+1 >= pCache.nMax /*|| pcache1UnderMemoryPressure(pCache)*/ {
-    pPage = pGroup.lru.pLruPrev
-    pCache.RemoveFromHash(pPage)
+  /* Step 4. Try to recycle a page. findVictim walks pGroup.lru from its
+  ** least-recently-used end, so the page recycled here may belong to a
+  ** sibling cache -- except one sitting at its reserved nMin, which is
+  ** skipped in favor of a less-reserved victim further up the list (see
+  ** PGroup.findVictim). If nothing in the whole group is eligible --
+  ** either every page is dirty, or every unpinned one belongs to a cache
+  ** already at its minimum -- ask xStress to write the oldest synced
+  ** dirty page out and make it clean instead of giving up and allocating
+  ** a brand new buffer. */
+  if pCache.nMax > 0 && pCache.nPage+1 >= pCache.nMax {
+    victim := pCache.pGroup.findVictim(pCache)
+    if victim == nil {
+      victim = pCache.stress()
+    }
+    if victim != nil {
+      pCache.pGroup.Pin(victim)
+      /* unlinkFromHash, not RemoveFromHash: the latter also calls
+      ** FreePage, which would push this exact *PgHdr* onto
+      ** victim.pCache.pFree while the code below reuses it directly as
+      ** pPage -- leaving it simultaneously "free" in the old cache and
+      ** live in the new one. */
+      victim.pCache.unlinkFromHash(victim)
+      /* Drop the victim's old content, as FreePage does, so ReadPage
+      ** reads the new key's image instead of returning the old one. */
+      victim.pBuf = nil
+      pPage = victim
+    }
   }
   /* Step 5. If a usable page buffer has still not been found,
   ** attempt to allocate a new one.
   */
   if pPage == nil {
-    pPage = pCache.AllocPage(pCache, createFlag==1);
+    pPage = pCache.AllocPage()
   }
 
   if pPage != nil {
-    h := iKey % pCache.nHash;
-    pCache.nPage++;
-    pPage.iKey = iKey;
-    pPage.pNext = pCache.apHash[h];
-    pPage.pCache = pCache;
-    pPage.pLruPrev = 0;
-    pPage.pLruNext = 0;
-    pPage.isPinned = 1;
-    pCache.apHash[h] = pPage;
-    if( iKey>pCache.iMaxKey ){
-      pCache.iMaxKey = iKey;
+    h := iKey % pCache.nHash
+    pCache.nPage++
+    pPage.iKey = iKey
+    pPage.pNext = pCache.apHash[h]
+    pPage.pCache = pCache
+    pPage.pLruPrev = nil
+    pPage.pLruNext = nil
+    pPage.nRef = 0
+    pCache.Ref(pPage)
+    pCache.apHash[h] = pPage
+    if iKey > pCache.iMaxKey {
+      pCache.iMaxKey = iKey
     }
   }
-  return pPage;
+  return pPage
 }
 
 /*
 ** Allocate a new page object initially associated with cache pCache.
 */
 func (pCache *PCache) AllocPage() *PgHdr {
-  if pCache.pFree /*|| (pCache.nPage==0 && pcache1InitBulk(pCache))*/{
+  if pCache.pFree != nil {
     page := pCache.pFree
     pCache.pFree = page.pNext
-    page.pNext = 0
+    page.pNext = nil
     return page
   }
-  pBulk := (*byte)(unsafe.Pointer(C.malloc()))//make([]byte, szBulk)
-  page = (*PgHdr)(unsafe.Pointer(pBulk))
-  page.pBuf = pBulk
-  page.isBulkLocal = 0
-  return page
+  return &PgHdr{}
 }
 
 /*
-** Free a page object allocated by pcache1AllocPage().
+** Free a page object allocated by AllocPage(). Its buffer is dropped,
+** not just its identity: a later AllocPage reusing this PgHdr must look
+** like a fresh one to ReadPage's pBuf==nil check, or it would hand back
+** another page's stale content under a new iKey.
 */
 func (pCache *PCache) FreePage(p *PgHdr){
-
-  // if( p.isBulkLocal ){
-  p.pNext = pCache.pFree;
-  pCache.pFree = p;
+  p.pBuf = nil
+  p.pNext = pCache.pFree
+  pCache.pFree = p
 }
 
 /*
@@ -207,47 +244,75 @@ func (pCache *PCache) FreePage(p *PgHdr){
 */
 func (pCache *PCache) ResizeHash(){
 
-  nNew := pCache.nHash*2;
-  if( nNew<256 ){
-    nNew = 256;
+  nNew := pCache.nHash*2
+  if nNew < 256 {
+    nNew = 256
   }
 
-  apNew := make([]*PgHdr, nNew);
+  apNew := make([]*PgHdr, nNew)
 
-  for i:=0; i<pCache.nHash; i++{
-    pCurPg := pCache.apHash[i];
+  for i := 0; i < pCache.nHash; i++ {
+    pCurPg := pCache.apHash[i]
     for pCurPg != nil {
-      h := pCurPg.iKey % nNew;
-      pNewPg := apNew[h]
-
+      next := pCurPg.pNext
+      h := pCurPg.iKey % nNew
+      pCurPg.pNext = apNew[h]
       apNew[h] = pCurPg
-      pCurPg = pCurPg.pNext
-      apNew[h].pNext = pNewPg
+      pCurPg = next
     }
   }
-  free(pCacheapHash);
-  pCache.apHash = apNew;
-  pCache.nHash = nNew;
+  pCache.apHash = apNew
+  pCache.nHash = nNew
 }
 
 /*
-** Remove the page supplied as an argument from the hash table
-** (PCache1.apHash structure) that it is currently stored in.
-** Also free the page if freePage is true.
-**
+** lookupHash returns the page cached under iKey, or nil if there isn't
+** one -- a read-only version of the walk RemoveFromHash does to find
+** pPage in its bucket, for callers that need to know whether a key is
+** cached without Fetch's side effect of creating (and Ref'ing) it when
+** it isn't.
 */
-func (pCache *PCache) RemoveFromHash(pPage *PgHdr) {
+func (pCache *PCache) lookupHash(iKey int) *PgHdr {
+  if pCache.nHash == 0 {
+    return nil
+  }
+  p := pCache.apHash[iKey%pCache.nHash]
+  for p != nil && p.iKey != iKey {
+    p = p.pNext
+  }
+  return p
+}
 
+/*
+** unlinkFromHash splices pPage out of its hash bucket, without freeing
+** it, returning whether pPage was actually found there. RemoveFromHash
+** and Rekey share this step; they differ in what happens to pPage
+** afterward -- RemoveFromHash frees it, Rekey reinserts the same header
+** under a new key.
+*/
+func (pCache *PCache) unlinkFromHash(pPage *PgHdr) bool {
   h := pPage.iKey % pCache.nHash
-  p := &pCache.apHash[h]
-  for p; (*p)!=pPage; p=&((*p).pNext) {}
-
-  if p == nil {
-    return
+  pp := &pCache.apHash[h]
+  for *pp != nil && *pp != pPage {
+    pp = &(*pp).pNext
   }
-  *p = (*p).pNext
 
+  if *pp == nil {
+    return false
+  }
+  *pp = pPage.pNext
   pCache.nPage--
+  return true
+}
+
+/*
+** Remove the page supplied as an argument from the hash table
+** (PCache.apHash structure) that it is currently stored in, and free it.
+*/
+func (pCache *PCache) RemoveFromHash(pPage *PgHdr) {
+  if !pCache.unlinkFromHash(pPage) {
+    return
+  }
   pCache.FreePage(pPage)
 }
 
@@ -259,38 +324,38 @@ func (pCache *PCache) RemoveFromHash(pPage *PgHdr) {
 */
 func (pCache *PCache) ManageDirtyList(pPage *PgHdr, addRemove uint8){
 
-  if addRemove & PCACHE_DIRTYLIST_REMOVE {
+  if addRemove & PCACHE_DIRTYLIST_REMOVE != 0 {
 
     /* Update the PCache.pSynced variable if necessary. */
-    // if( p.pSynced==pPage ){
-    //   p.pSynced = pPage.pDirtyPrev;
-    // }
+    if pCache.pSynced == pPage {
+      pCache.pSynced = pPage.pDirtyPrev
+    }
 
     if pPage.pDirtyNext != nil {
-      pPage.pDirtyNext.pDirtyPrev = pPage.pDirtyPrev;
+      pPage.pDirtyNext.pDirtyPrev = pPage.pDirtyPrev
     }else{
-      pCache.pDirtyTail = pPage.pDirtyPrev;
+      pCache.pDirtyTail = pPage.pDirtyPrev
     }
     if pPage.pDirtyPrev != nil {
-      pPage.pDirtyPrev.pDirtyNext = pPage.pDirtyNext;
+      pPage.pDirtyPrev.pDirtyNext = pPage.pDirtyNext
     }else{
       /* If there are now no dirty pages in the cache, set eCreate to 2.
       ** This is an optimization that allows sqlite3PcacheFetch() to skip
       ** searching for a dirty page to eject from the cache when it might
       ** otherwise have to.  */
-      pCache.pDirty = pPage.pDirtyNext;
+      pCache.pDirty = pPage.pDirtyNext
     }
-    pPage.pDirtyNext = 0;
-    pPage.pDirtyPrev = 0;
+    pPage.pDirtyNext = nil
+    pPage.pDirtyPrev = nil
   }
-  if( addRemove & PCACHE_DIRTYLIST_ADD ){
-    pPage.pDirtyNext = p.pDirty;
-    if( pPage.pDirtyNext ){
-      pPage.pDirtyNext.pDirtyPrev = pPage;
+  if addRemove & PCACHE_DIRTYLIST_ADD != 0 {
+    pPage.pDirtyNext = pCache.pDirty
+    if pPage.pDirtyNext != nil {
+      pPage.pDirtyNext.pDirtyPrev = pPage
     }else{
-      pCache.pDirtyTail = pPage;
+      pCache.pDirtyTail = pPage
     }
-    pCache.pDirty = pPage;
+    pCache.pDirty = pPage
   }
 }
 
@@ -302,6 +367,11 @@ func (pCache *PCache) MakeDirty(p *PgHdr){
   if p.flags & PGHDR_CLEAN != 0 {
     p.flags ^= (PGHDR_DIRTY|PGHDR_CLEAN)
     pCache.ManageDirtyList(p, PCACHE_DIRTYLIST_ADD)
+    if p.nRef == 0 {
+      /* Was only on the LRU because it was unreferenced and clean;
+      ** now dirty, the invariant says it must come off. */
+      pCache.pGroup.Pin(p)
+    }
   }
 }
 
@@ -312,8 +382,13 @@ func (pCache *PCache) MakeDirty(p *PgHdr){
 func (pCache *PCache) MakeClean(page *PgHdr){
   if (page.flags & PGHDR_DIRTY) != 0 {
     pCache.ManageDirtyList(page, PCACHE_DIRTYLIST_REMOVE)
-    page.flags &= ^(PGHDR_DIRTY|PGHDR_NEED_SYNC|PGHDR_WRITEABLE)
+    page.flags &= ^uint16(PGHDR_DIRTY|PGHDR_NEED_SYNC|PGHDR_WRITEABLE)
     page.flags |= PGHDR_CLEAN
+    if page.nRef == 0 {
+      /* Now clean and unreferenced: back on the LRU so Fetch may
+      ** recycle it. */
+      pCache.pGroup.Unpin(page)
+    }
   }
 }
 
@@ -321,8 +396,158 @@ func (pCache *PCache) MakeClean(page *PgHdr){
 ** Make every page in the cache clean.
 */
 func (pCache *PCache) MakeCleanAll(){
-  for pCache.pDirty != 0 {
+  for pCache.pDirty != nil {
     p := pCache.pDirty
     pCache.MakeClean(p)
   }
 }
+
+/*
+** DirtyPages returns every page currently on the dirty list, newest
+** first. This is what Commit (pager.go) walks to flush a transaction --
+** kept on the PageCache interface so every backend, not just the
+** default hash+LRU one, can participate in a commit.
+*/
+func (pCache *PCache) DirtyPages() []*PgHdr {
+  var out []*PgHdr
+  for pg := pCache.pDirty; pg != nil; pg = pg.pDirtyNext {
+    out = append(out, pg)
+  }
+  return out
+}
+
+/*
+** stress asks xStress (set by OpenPager, see pager.go)
+** to write the oldest fully-synced dirty page out to backing store so it
+** can be marked clean and recycled. Pages whose PGHDR_NEED_SYNC bit is
+** still set are skipped -- writing them out before the journal/WAL frame
+** that protects them has been synced would be unsafe -- which is exactly
+** what the pSynced pointer exists to make cheap: it remembers how far
+** down pDirty the last walk already got.
+*/
+func (pCache *PCache) stress() *PgHdr {
+  if pCache.xStress == nil {
+    return nil
+  }
+  p := pCache.pSynced
+  if p == nil {
+    p = pCache.pDirtyTail
+  }
+  for p != nil && (p.flags & PGHDR_NEED_SYNC) != 0 {
+    p = p.pDirtyPrev
+  }
+  pCache.pSynced = p
+  if p == nil {
+    return nil
+  }
+  if err := pCache.xStress(p); err != nil {
+    return nil
+  }
+  pCache.MakeClean(p)
+  return p
+}
+
+/*
+** Ref adds a reference to p. The invariant p is on pGroup's LRU list iff
+** nRef==0 && page is clean means the first reference must pull p off
+** that list so the recycler in Fetch can no longer consider it.
+*/
+func (pCache *PCache) Ref(p *PgHdr){
+  p.nRef++
+  pCache.nRefSum++
+  if p.nRef == 1 {
+    pCache.pGroup.Pin(p)
+  }
+}
+
+/*
+** Unref releases a reference added by Ref. Once the last reference is
+** gone, a clean page rejoins pGroup's LRU list so Fetch may recycle it; a
+** dirty page stays off the list until MakeClean (or a commit) clears
+** PGHDR_DIRTY.
+*/
+func (pCache *PCache) Unref(p *PgHdr){
+  p.nRef--
+  pCache.nRefSum--
+  if p.nRef == 0 && (p.flags & PGHDR_DIRTY) == 0 {
+    pCache.pGroup.Unpin(p)
+  }
+}
+
+/*
+** AssertNoRefs panics if any page in this cache still has an outstanding
+** reference. The pager calls this before closing a transaction to catch
+** a caller that forgot to Unpin a page it fetched.
+*/
+func (pCache *PCache) AssertNoRefs(){
+  if pCache.nRefSum != 0 {
+    panic("pcache: outstanding page references at transaction close")
+  }
+}
+
+/*
+** Unpin releases a reference obtained from Fetch(). If reuse is false the
+** page is removed from the hash table immediately instead of being left
+** for the LRU recycler to find later.
+*/
+func (pCache *PCache) Unpin(p *PgHdr, reuse bool){
+  pCache.Unref(p)
+  if reuse || p.nRef > 0 {
+    return
+  }
+  pCache.pGroup.Pin(p) // unlink from the LRU list (if Unref put it there) before freeing
+  pCache.RemoveFromHash(p)
+}
+
+/*
+** Change the page number of an existing cached page from iOld to iNew,
+** discarding whatever page is already cached under iNew. p itself is
+** only unlinked from its old bucket, not freed -- it is still live and
+** about to be reinserted under iNew, unlike existing, which really is
+** being evicted.
+*/
+func (pCache *PCache) Rekey(p *PgHdr, iOld int, iNew int){
+  if existing := pCache.lookupHash(iNew); existing != nil {
+    pCache.RemoveFromHash(existing)
+  }
+  pCache.unlinkFromHash(p)
+  h := iNew % pCache.nHash
+  p.iKey = iNew
+  p.pNext = pCache.apHash[h]
+  pCache.apHash[h] = p
+  pCache.nPage++
+}
+
+/*
+** Discard every page in the cache with iKey>=iLimit. See
+** PGroup.Truncate for the rule on pages still pinned above the limit.
+*/
+func (pCache *PCache) Truncate(iLimit int){
+  pCache.pGroup.Truncate(pCache, iLimit)
+}
+
+/*
+** Return the number of pages currently held by the cache.
+*/
+func (pCache *PCache) PageCount() int {
+  return pCache.nPage
+}
+
+/*
+** Release the bulk allocation back to the OS. Pages already handed out
+** via AllocPage remain valid; only the free list built by InitBulk is
+** dropped.
+*/
+func (pCache *PCache) Shrink(){
+  pCache.pBulk = nil
+  pCache.pFree = nil
+}
+
+/*
+** Configure the "cache_size" value. Fetch starts recycling from the LRU
+** list once adding a page would bring the cache to nMax pages
+** (nPage+1 >= nMax); 0 disables recycling.
+*/
+func (pCache *PCache) SetCacheSize(nMax int){
+  pCache.nMax = nMax
+}
@@ -0,0 +1,36 @@
+package bplustree
+
+import "testing"
+
+/*
+** Fetch pins its page, so AssertNoRefs must panic while that reference
+** (or an extra one taken with Ref) is still outstanding, and must stay
+** quiet once every Ref has a matching Unref/Unpin.
+*/
+func TestRefUnrefAndAssertNoRefs(t *testing.T) {
+  cache := &PCache{nMax: 4}
+  cache.Create(64)
+
+  pg := cache.Fetch(1)
+  if pg.nRef != 1 {
+    t.Fatalf("nRef after Fetch = %d, want 1", pg.nRef)
+  }
+
+  cache.Ref(pg)
+  if pg.nRef != 2 {
+    t.Fatalf("nRef after Ref = %d, want 2", pg.nRef)
+  }
+
+  cache.Unref(pg)
+  func() {
+    defer func() {
+      if recover() == nil {
+        t.Fatal("expected AssertNoRefs to panic with an outstanding reference")
+      }
+    }()
+    cache.AssertNoRefs()
+  }()
+
+  cache.Unref(pg)
+  cache.AssertNoRefs() // must not panic: every Ref now has a matching Unref
+}
@@ -0,0 +1,142 @@
+package bplustree
+
+import "testing"
+
+/*
+** A cache at capacity with nothing clean to recycle must fall back to
+** xStress to flush the oldest dirty page out and make it clean, rather
+** than Fetch falling back to a freshly allocated page.
+*/
+func TestStressFlushesDirtyVictim(t *testing.T) {
+  cache := &PCache{nMax: 1}
+  cache.Create(64)
+
+  var flushed []int
+  cache.xStress = func(p *PgHdr) error {
+    flushed = append(flushed, p.iKey)
+    return nil
+  }
+
+  pg1 := cache.Fetch(1)
+  pg1.flags = PGHDR_CLEAN // mirrors what Pager.ReadPage does once a fresh page's buffer is filled
+  cache.MakeDirty(pg1)
+  cache.Unref(pg1) // release the Fetch reference; pg1 stays off the LRU because it is dirty
+
+  pg2 := cache.Fetch(2)
+  if pg2 == nil {
+    t.Fatal("Fetch(2) returned nil")
+  }
+  if len(flushed) != 1 || flushed[0] != 1 {
+    t.Fatalf("expected xStress to flush page 1, got %v", flushed)
+  }
+  if pg1.flags&PGHDR_CLEAN == 0 {
+    t.Fatal("expected stress() to mark the flushed page clean")
+  }
+}
+
+/*
+** Unpin discarding a still-dirty page (reuse=false) must not underflow
+** nPurgeable: a dirty page never rode the shared LRU list in the first
+** place (MakeDirty pulls it off, see PGroup.Pin), so PGroup.Pin's
+** decrement on Unpin's forced unlink must be a no-op here, not an
+** unconditional one.
+*/
+func TestUnpinDiscardingDirtyPageDoesNotUnderflowPurgeable(t *testing.T) {
+  cache := &PCache{nMax: 4}
+  cache.Create(64)
+
+  pg := cache.Fetch(1)
+  pg.flags = PGHDR_CLEAN
+  cache.MakeDirty(pg)
+  cache.Unpin(pg, false) // discard the dirty page outright
+
+  if cache.nPurgeable != 0 {
+    t.Fatalf("nPurgeable = %d, want 0; Pin decremented for a page never on the LRU", cache.nPurgeable)
+  }
+}
+
+/*
+** Rekey must not leave nRefSum permanently off by one when iNew isn't
+** already cached: Fetch would have created and Ref'd a phantom page as
+** a side effect of merely checking, and RemoveFromHash discards a page
+** without ever Unref'ing it first.
+*/
+func TestRekeyDoesNotLeakARefWhenNewKeyIsUncached(t *testing.T) {
+  cache := &PCache{}
+  cache.Create(64)
+
+  pg := cache.Fetch(1)
+  cache.Unpin(pg, true)
+
+  cache.Rekey(pg, 1, 2)
+
+  if cache.nRefSum != 0 {
+    t.Fatalf("nRefSum after Rekey = %d, want 0 (Rekey must not Fetch iNew to check it)", cache.nRefSum)
+  }
+  cache.AssertNoRefs() // must not panic
+}
+
+/*
+** Rekey must not destroy p's content in the process of moving it: the
+** naive implementation unlinked p via RemoveFromHash, which also calls
+** FreePage and pushes p onto pFree, so the "rekeyed" page came back with
+** pBuf wiped, and a later unrelated Fetch handed the same, still-live
+** PgHdr back out as a supposedly fresh page.
+*/
+func TestRekeyPreservesPageContent(t *testing.T) {
+  cache := &PCache{}
+  cache.Create(64)
+
+  pg := cache.Fetch(1)
+  buf := byte(0xAB)
+  pg.pBuf = &buf
+  cache.Unpin(pg, true)
+
+  cache.Rekey(pg, 1, 2)
+
+  got := cache.Fetch(2)
+  if got != pg {
+    t.Fatalf("Fetch(2) = %p, want the rekeyed header %p", got, pg)
+  }
+  if got.pBuf != &buf {
+    t.Fatal("Rekey destroyed the page's content (pBuf no longer points at its original buffer)")
+  }
+  cache.Unref(got)
+
+  other := cache.Fetch(3)
+  if other == pg {
+    t.Fatal("Fetch(3) handed back the rekeyed page's PgHdr from pFree -- Rekey freed it instead of just unlinking it")
+  }
+}
+
+/*
+** Fetch recycling a victim page must only unlink it from the old hash
+** bucket, not free it: RemoveFromHash also pushes the victim's *PgHdr
+** onto pCache.pFree, so the header ends up both "free" there and live
+** under its new key at the same time -- the next unrelated AllocPage
+** would pop it straight back off pFree and hand the same, still-live
+** *PgHdr out again as a supposedly distinct page.
+*/
+func TestFetchRecyclingVictimDoesNotDoubleFreeItsHeader(t *testing.T) {
+  group := NewPGroup()
+  a := &PCache{nMax: 1}
+  b := &PCache{nMax: 1}
+  group.Attach(a)
+  group.Attach(b)
+  a.Create(64)
+  b.Create(64)
+
+  pgB := b.Fetch(2)
+  b.Unpin(pgB, true) // drop the ref but keep it cached, landing it on the shared LRU for a to steal
+
+  pgA := a.Fetch(3)
+  if pgA != pgB {
+    t.Fatalf("a.Fetch(3) = %p, want the recycled header %p", pgA, pgB)
+  }
+
+  for p := b.pFree; p != nil; p = p.pNext {
+    if p == pgB {
+      t.Fatal("recycled header is also sitting on b.pFree -- a later AllocPage would hand out the same live *PgHdr a second time")
+    }
+  }
+}
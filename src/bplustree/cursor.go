@@ -0,0 +1,478 @@
+package bplustree
+
+import (
+  "errors"
+  "unsafe"
+)
+
+/* maxCells is the largest number of Cell entries that fit in pg's cell
+** pointer array. cells() (overflow.go) only ever exposes the first
+** ph.nCell of them; removeCellAt/appendCell/prependCell need the rest of
+** the backing array to shift cells into. */
+func (pg *MemPage) maxCells() int {
+  return int(pg.pBt.usableSize) / int(unsafe.Sizeof(Cell{}))
+}
+
+func (pg *MemPage) allCells() []Cell {
+  return unsafe.Slice((*Cell)(pg.cell), pg.maxCells())
+}
+
+/* removeCellAt deletes the cell at idx, shifting every following cell
+** down by one. */
+func (pg *MemPage) removeCellAt(idx int) {
+  cells := pg.allCells()
+  n := int(pg.ph.nCell)
+  copy(cells[idx:n-1], cells[idx+1:n])
+  pg.ph.nCell--
+}
+
+/* appendCell adds c as the new last cell on pg. */
+func (pg *MemPage) appendCell(c Cell) {
+  cells := pg.allCells()
+  cells[pg.ph.nCell] = c
+  pg.ph.nCell++
+}
+
+/* prependCell adds c as the new first cell on pg, shifting every
+** existing cell up by one. */
+func (pg *MemPage) prependCell(c Cell) {
+  cells := pg.allCells()
+  n := int(pg.ph.nCell)
+  copy(cells[1:n+1], cells[0:n])
+  cells[0] = c
+  pg.ph.nCell++
+}
+
+/* insertCellAt inserts c at idx, shifting cells from idx on up by one.
+** Unlike appendCell/prependCell the target position isn't always an
+** end, which is what Insert's non-splitting leaf and interior paths
+** (insertAt, insertInterior) need. */
+func (pg *MemPage) insertCellAt(idx int, c Cell) {
+  cells := pg.allCells()
+  n := int(pg.ph.nCell)
+  copy(cells[idx+1:n+1], cells[idx:n])
+  cells[idx] = c
+  pg.ph.nCell++
+}
+
+/*
+** minCells is the fewest cells a non-root page is allowed to hold before
+** Cursor.Delete must borrow from a sibling or merge with one. It plays
+** the role maxLeaf/minLeaf play for payload size: a lower bound enforced
+** after every removal.
+*/
+const minCells = 2
+
+/*
+** frame is one level of a Cursor's path from root to leaf: the page at
+** that level and the index of the cell the cursor is currently
+** positioned on within it.
+*/
+type frame struct {
+  pg *MemPage
+  idx int
+}
+
+/*
+** Cursor iterates over a BPlusTree's keys in order and supports removal.
+** It carries the full root-to-leaf path as a stack of frames so Next and
+** Prev can step to a neighboring cell, descending into a sibling subtree
+** only when the current leaf is exhausted, in O(1) amortized time
+** instead of re-descending from the root on every step.
+*/
+type Cursor struct {
+  bt *BPlusTree
+  stack []frame
+  valid bool
+}
+
+/*
+** NewCursor returns a Cursor over bt. The cursor is not positioned on any
+** entry until Seek is called; Next and Prev return an error before that.
+*/
+func NewCursor(bt *BPlusTree) *Cursor {
+  return &Cursor{bt: bt}
+}
+
+/* top returns the cursor's current (leaf) frame. */
+func (c *Cursor) top() *frame {
+  return &c.stack[len(c.stack)-1]
+}
+
+/*
+** Seek positions the cursor at the smallest key >= key, descending from
+** the root and pushing a frame for every page visited along the way.
+** c.Key()/c.Value() are usable afterwards iff Seek returns true.
+*/
+func (c *Cursor) Seek(key int) (bool, error) {
+  c.stack = c.stack[:0]
+  c.valid = false
+
+  pg := c.bt.MemPage
+  for {
+    idx := pg.seekCell(key)
+    c.stack = append(c.stack, frame{pg: pg, idx: idx})
+
+    if pg.ph.flag == LEAFPAGE {
+      c.valid = idx < int(pg.ph.nCell) && pg.cells()[idx].key == uint32(key)
+      return c.valid, nil
+    }
+
+    cells := pg.cells()
+    if idx >= len(cells) {
+      idx = len(cells) - 1
+      c.stack[len(c.stack)-1].idx = idx
+    }
+    child, ok := c.bt.hm[cells[idx].ptr]
+    if !ok {
+      return false, errors.New("bplustree: dangling child pointer")
+    }
+    pg = child
+  }
+}
+
+/* seekCell returns the index of the first cell on pg whose key is >=
+** key, or pg.ph.nCell if every cell's key is smaller. */
+func (pg *MemPage) seekCell(key int) int {
+  cells := pg.cells()
+  lo, hi := 0, len(cells)
+  for lo < hi {
+    mid := (lo + hi) / 2
+    if uint32(cells[mid].key) < uint32(key) {
+      lo = mid + 1
+    } else {
+      hi = mid
+    }
+  }
+  return lo
+}
+
+/* descendToFirst pushes frames down the leftmost path from pg to a leaf. */
+func (c *Cursor) descendToFirst(pg *MemPage) error {
+  for {
+    c.stack = append(c.stack, frame{pg: pg, idx: 0})
+    if pg.ph.flag == LEAFPAGE {
+      return nil
+    }
+    child, ok := c.bt.hm[pg.cells()[0].ptr]
+    if !ok {
+      return errors.New("bplustree: dangling child pointer")
+    }
+    pg = child
+  }
+}
+
+/* descendToLast pushes frames down the rightmost path from pg to a leaf. */
+func (c *Cursor) descendToLast(pg *MemPage) error {
+  for {
+    last := int(pg.ph.nCell) - 1
+    c.stack = append(c.stack, frame{pg: pg, idx: last})
+    if pg.ph.flag == LEAFPAGE {
+      return nil
+    }
+    child, ok := c.bt.hm[pg.cells()[last].ptr]
+    if !ok {
+      return errors.New("bplustree: dangling child pointer")
+    }
+    pg = child
+  }
+}
+
+/*
+** Next advances the cursor to the next key in order. It returns false
+** once the cursor runs off the end of the tree.
+*/
+func (c *Cursor) Next() (bool, error) {
+  if len(c.stack) == 0 {
+    return false, errors.New("bplustree: Next called before Seek")
+  }
+
+  top := c.top()
+  top.idx++
+  if top.idx < int(top.pg.ph.nCell) {
+    c.valid = true
+    return true, nil
+  }
+
+  /* Leaf exhausted: pop up until a parent frame has a next child,
+  ** then descend that child's leftmost path. */
+  for len(c.stack) > 1 {
+    c.stack = c.stack[:len(c.stack)-1]
+    parent := c.top()
+    parent.idx++
+    if parent.idx < len(parent.pg.cells()) {
+      child, ok := c.bt.hm[parent.pg.cells()[parent.idx].ptr]
+      if !ok {
+        return false, errors.New("bplustree: dangling child pointer")
+      }
+      if err := c.descendToFirst(child); err != nil {
+        return false, err
+      }
+      c.valid = true
+      return true, nil
+    }
+  }
+
+  c.stack = c.stack[:0]
+  c.valid = false
+  return false, nil
+}
+
+/*
+** Prev moves the cursor to the previous key in order. It returns false
+** once the cursor runs off the start of the tree.
+*/
+func (c *Cursor) Prev() (bool, error) {
+  if len(c.stack) == 0 {
+    return false, errors.New("bplustree: Prev called before Seek")
+  }
+
+  top := c.top()
+  top.idx--
+  if top.idx >= 0 {
+    c.valid = true
+    return true, nil
+  }
+
+  for len(c.stack) > 1 {
+    c.stack = c.stack[:len(c.stack)-1]
+    parent := c.top()
+    parent.idx--
+    if parent.idx >= 0 {
+      child, ok := c.bt.hm[parent.pg.cells()[parent.idx].ptr]
+      if !ok {
+        return false, errors.New("bplustree: dangling child pointer")
+      }
+      if err := c.descendToLast(child); err != nil {
+        return false, err
+      }
+      c.valid = true
+      return true, nil
+    }
+  }
+
+  c.stack = c.stack[:0]
+  c.valid = false
+  return false, nil
+}
+
+/* Key returns the key the cursor is currently positioned on. */
+func (c *Cursor) Key() (uint32, error) {
+  if !c.valid {
+    return 0, errors.New("bplustree: cursor not positioned on an entry")
+  }
+  top := c.top()
+  return top.pg.cells()[top.idx].key, nil
+}
+
+/* Value returns the full payload (following any overflow chain) the
+** cursor is currently positioned on. */
+func (c *Cursor) Value() ([]byte, error) {
+  if !c.valid {
+    return nil, errors.New("bplustree: cursor not positioned on an entry")
+  }
+  top := c.top()
+  return readPayload(top.pg, top.idx)
+}
+
+/*
+** Delete removes the entry the cursor is positioned on under its own
+** pager transaction (mirroring Insert), freeing its overflow chain (if
+** any) first, then rebalancing the tree on the way back up to the root:
+** a leaf that falls below minCells first tries to borrow a cell from an
+** immediate sibling, and only merges with that sibling -- dropping the
+** absorbed page's cell from the parent and recursing the removal up a
+** level -- when there is nothing to borrow. A root left with a single
+** child is collapsed, shrinking the tree's height by one. The cursor is
+** left invalid; callers must Seek again before reading further.
+*/
+func (c *Cursor) Delete() error {
+  if !c.valid {
+    return errors.New("bplustree: Delete called on an invalid cursor")
+  }
+
+  bt := c.bt
+  if err := bt.Pager.Begin(); err != nil {
+    return err
+  }
+
+  top := c.top()
+  if head := overflowHead(top.pg, top.idx); head != 0 {
+    if err := freeOverflowChain(bt.Pager, head); err != nil {
+      bt.Pager.Rollback()
+      return err
+    }
+  }
+  top.pg.removeCellAt(top.idx)
+  if err := top.pg.writePage(); err != nil {
+    bt.Pager.Rollback()
+    return err
+  }
+
+  for level := len(c.stack) - 1; level > 0; level-- {
+    pg := c.stack[level].pg
+    if int(pg.ph.nCell) >= minCells {
+      break
+    }
+
+    parent := c.stack[level-1].pg
+    childIdx := c.stack[level-1].idx
+    more, err := c.rebalance(parent, childIdx, pg)
+    if err != nil {
+      bt.Pager.Rollback()
+      return err
+    }
+    if !more {
+      break
+    }
+  }
+
+  root := bt.MemPage
+  if root.ph.flag == INTERPAGE && root.ph.nCell == 1 {
+    only, ok := bt.hm[root.cells()[0].ptr]
+    if ok {
+      bt.MemPage = only
+      /* The old root is discarded the same way mergeWith discards an
+      ** absorbed sibling: handed back to the freelist, its residency
+      ** reference released, and its bt.hm entry dropped so a later
+      ** AllocatePage reusing this pgno doesn't find a stale MemPage
+      ** still sitting there. reuse=true, not false, for the same reason
+      ** mergeWith uses it: FreePage may have just repurposed this pgno as
+      ** the new freelist trunk, and forcibly evicting its cache entry
+      ** would corrupt the shared LRU list under Pager.freelistHead. */
+      if err := bt.Pager.FreePage(uint32(root.ph.pgno)); err != nil {
+        bt.Pager.Rollback()
+        return err
+      }
+      bt.Pager.cache.Unpin(root.pgHdr, true)
+      delete(bt.hm, uint32(root.ph.pgno))
+    }
+  }
+
+  c.stack = c.stack[:0]
+  c.valid = false
+
+  if err := bt.commit(); err != nil {
+    return err
+  }
+  return bt.saveCatalog()
+}
+
+/*
+** rebalance restores pg (the childIdx'th child of parent) to minCells by
+** borrowing a cell from an adjacent sibling, or merging with one and
+** removing the now-redundant separator key from parent. It returns true
+** after a merge, since parent has then lost a cell; Delete checks at the
+** next level up whether parent is below minCells and needs the same
+** treatment.
+*/
+func (c *Cursor) rebalance(parent *MemPage, childIdx int, pg *MemPage) (bool, error) {
+  cells := parent.cells()
+
+  if childIdx+1 < len(cells) {
+    if right, ok := c.bt.hm[cells[childIdx+1].ptr]; ok && int(right.ph.nCell) > minCells {
+      return false, pg.borrowFrom(right, parent, childIdx, true)
+    }
+  }
+  if childIdx > 0 {
+    if left, ok := c.bt.hm[cells[childIdx-1].ptr]; ok && int(left.ph.nCell) > minCells {
+      return false, pg.borrowFrom(left, parent, childIdx-1, false)
+    }
+  }
+
+  if childIdx+1 < len(cells) {
+    if right, ok := c.bt.hm[cells[childIdx+1].ptr]; ok {
+      return true, pg.mergeWith(right, parent, childIdx)
+    }
+  }
+  if childIdx > 0 {
+    if left, ok := c.bt.hm[cells[childIdx-1].ptr]; ok {
+      return true, left.mergeWith(pg, parent, childIdx-1)
+    }
+  }
+  return false, nil
+}
+
+/* writePage persists pg's in-memory mutation through its BPlusTree's
+** Pager, the same WritePage call insertAt makes after a leaf/interior
+** cell edit. It is a no-op for a bare MemPage with no backing
+** BPlusTree/Pager, the defensive pattern mergeWith already used for
+** FreePage before this existed. */
+func (pg *MemPage) writePage() error {
+  if pg.pBt == nil || pg.pBt.Pager == nil {
+    return nil
+  }
+  return pg.pBt.Pager.WritePage(pg.pgHdr)
+}
+
+/*
+** borrowFrom moves one cell between pg and sibling (sibFromRight
+** selects which neighbor sibling is) and rewrites the separator key in
+** parent at cells()[sepIdx] to match the new split point: per the
+** ceiling-key invariant insertAt establishes, cells()[sepIdx].key must
+** always equal the actual max key of the child at index sepIdx, so
+** whichever of pg/sibling sits at that index is the one whose new max
+** gets written back, not the other side's.
+*/
+func (pg *MemPage) borrowFrom(sibling *MemPage, parent *MemPage, sepIdx int, sibFromRight bool) error {
+  if sibFromRight {
+    moved := sibling.cells()[0]
+    sibling.removeCellAt(0)
+    pg.appendCell(moved)
+    parent.cells()[sepIdx].key = moved.key
+  } else {
+    last := len(sibling.cells()) - 1
+    moved := sibling.cells()[last]
+    sibling.removeCellAt(last)
+    pg.prependCell(moved)
+    parent.cells()[sepIdx].key = sibling.cells()[len(sibling.cells())-1].key
+  }
+  if err := pg.writePage(); err != nil {
+    return err
+  }
+  if err := sibling.writePage(); err != nil {
+    return err
+  }
+  return parent.writePage()
+}
+
+/*
+** mergeWith folds right's cells into pg, the survivor at parent's own
+** cells()[sepIdx] (the pointer half of that cell already points at pg).
+** Since pg's max key is now right's old max, cells()[sepIdx].key is
+** brought up to date from cells()[sepIdx+1] -- right's entry -- before
+** that entry is the one removed, not pg's own; right's old page is
+** handed back to the pager's freelist, see FreePage in pager.go. right's
+** entry in bt.hm is dropped along with it -- otherwise a later
+** AllocatePage reusing that pgno would leave bt.hm pointing at this
+** stale, logically-deleted MemPage. Dropping it from bt.hm also means
+** bt.commit's Unpin/re-Fetch cycle (see BPlusTree.commit) will never
+** visit it again, so the residency reference newPage/loadCatalog took on
+** its behalf has to come off here instead, or Pager.Commit's
+** AssertNoRefs trips on it. That Unpin passes reuse=true, not false:
+** FreePage may have just turned right.ph.pgno into the new freelist
+** trunk page (if the freelist was empty or its old trunk was full), in
+** which case Pager.freelistHead now points at this exact cache entry and
+** forcibly evicting it from the hash table out from under that pointer
+** would corrupt the shared LRU list the next time it's fetched.
+*/
+func (pg *MemPage) mergeWith(right *MemPage, parent *MemPage, sepIdx int) error {
+  for _, cell := range right.cells() {
+    pg.appendCell(cell)
+  }
+  parent.cells()[sepIdx].key = parent.cells()[sepIdx+1].key
+  parent.removeCellAt(sepIdx + 1)
+  if parent.pBt != nil && parent.pBt.Pager != nil {
+    if err := parent.pBt.Pager.FreePage(uint32(right.ph.pgno)); err != nil {
+      return err
+    }
+    parent.pBt.Pager.cache.Unpin(right.pgHdr, true)
+  }
+  if parent.pBt != nil {
+    delete(parent.pBt.hm, uint32(right.ph.pgno))
+  }
+  if err := pg.writePage(); err != nil {
+    return err
+  }
+  return parent.writePage()
+}
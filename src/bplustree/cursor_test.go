@@ -0,0 +1,249 @@
+package bplustree
+
+import (
+  "testing"
+  "unsafe"
+)
+
+func insertInt(t *testing.T, bt *BPlusTree, key uint32, value string) {
+  data := []byte(value)
+  pl := &Payload{key: key, size: uint16(len(data))}
+  if len(data) > 0 {
+    pl.entrys = unsafe.Pointer(&data[0])
+  }
+  if err := bt.Insert(pl); err != nil {
+    t.Fatalf("Insert(%d): %v", key, err)
+  }
+}
+
+/*
+** A Cursor must walk keys in order via Next/Prev regardless of where
+** Seek lands, and Delete must make a removed key unreachable by a
+** subsequent Seek.
+*/
+func TestCursorSeekNextPrevAndDelete(t *testing.T) {
+  path := t.TempDir() + "/test.db"
+  bt, err := Open(path, "memory", 4096, JournalRollback)
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+
+  for i := uint32(0); i < 10; i++ {
+    insertInt(t, bt, i, "v")
+  }
+
+  c := NewCursor(bt)
+  found, err := c.Seek(0)
+  if err != nil || !found {
+    t.Fatalf("Seek(0) = %v, %v; want true, nil", found, err)
+  }
+
+  for i := uint32(0); i < 10; i++ {
+    key, err := c.Key()
+    if err != nil {
+      t.Fatalf("Key() at %d: %v", i, err)
+    }
+    if key != i {
+      t.Fatalf("Key() = %d, want %d", key, i)
+    }
+    if i < 9 {
+      if ok, err := c.Next(); err != nil || !ok {
+        t.Fatalf("Next() at %d = %v, %v; want true, nil", i, ok, err)
+      }
+    }
+  }
+
+  for i := uint32(9); i > 0; i-- {
+    if ok, err := c.Prev(); err != nil || !ok {
+      t.Fatalf("Prev() at %d = %v, %v; want true, nil", i, ok, err)
+    }
+    key, err := c.Key()
+    if err != nil {
+      t.Fatalf("Key() after Prev at %d: %v", i, err)
+    }
+    if key != i-1 {
+      t.Fatalf("Key() after Prev = %d, want %d", key, i-1)
+    }
+  }
+
+  if _, err := c.Seek(5); err != nil {
+    t.Fatalf("Seek(5): %v", err)
+  }
+  if err := c.Delete(); err != nil {
+    t.Fatalf("Delete: %v", err)
+  }
+
+  found, err = c.Seek(5)
+  if err != nil {
+    t.Fatalf("Seek(5) after Delete: %v", err)
+  }
+  if found {
+    t.Fatal("expected key 5 to be gone after Delete")
+  }
+}
+
+/*
+** A small page size forces enough splits that deleting every key back
+** out drives both rebalance paths in Cursor.rebalance: borrowing a cell
+** from a still-roomy sibling, and merging with one that has nothing to
+** spare. Every surviving key must stay reachable by Seek after each
+** single Delete, not just at the end.
+*/
+func TestCursorDeleteRebalancesAcrossSplitTree(t *testing.T) {
+  path := t.TempDir() + "/test.db"
+  bt, err := Open(path, "memory", 512, JournalRollback)
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+
+  const n = 40
+  for i := uint32(0); i < n; i++ {
+    insertInt(t, bt, i, "payload bytes to force a small page to split")
+  }
+
+  c := NewCursor(bt)
+  for i := uint32(0); i < n; i++ {
+    found, err := c.Seek(int(i))
+    if err != nil {
+      t.Fatalf("Seek(%d) before its own delete turn: %v", i, err)
+    }
+    if !found {
+      t.Fatalf("key %d already gone before its own delete turn", i)
+    }
+    if err := c.Delete(); err != nil {
+      t.Fatalf("Delete(%d): %v", i, err)
+    }
+
+    for j := i + 1; j < n; j++ {
+      found, err := c.Seek(int(j))
+      if err != nil {
+        t.Fatalf("Seek(%d) after deleting %d: %v", j, i, err)
+      }
+      if !found {
+        t.Fatalf("key %d missing after deleting %d; rebalance corrupted the tree", j, i)
+      }
+    }
+  }
+}
+
+/*
+** Deleting every key out of a tree that split into an interior root must
+** collapse that root once it is down to its one surviving child: this
+** codebase's interior convention is N cells == N children, so a
+** single-child root has nCell == 1, not 0. The old root's page must also
+** come back to the pager's freelist instead of leaking forever.
+*/
+func TestCursorDeleteCollapsesRootWithOneChild(t *testing.T) {
+  path := t.TempDir() + "/test.db"
+  bt, err := Open(path, "memory", 512, JournalRollback)
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+
+  const n = 40
+  for i := uint32(0); i < n; i++ {
+    insertInt(t, bt, i, "payload bytes to force a small page to split")
+  }
+  if bt.MemPage.ph.flag != INTERPAGE {
+    t.Fatal("test setup: expected the tree to have split into an interior root")
+  }
+  oldRootPgno := bt.MemPage.ph.pgno
+
+  c := NewCursor(bt)
+  for i := uint32(0); i < n; i++ {
+    if found, err := c.Seek(int(i)); err != nil || !found {
+      t.Fatalf("Seek(%d): %v, %v", i, found, err)
+    }
+    if err := c.Delete(); err != nil {
+      t.Fatalf("Delete(%d): %v", i, err)
+    }
+  }
+
+  if bt.MemPage.ph.flag != LEAFPAGE {
+    t.Fatalf("root flag = %d, want LEAFPAGE; root never collapsed down to a single leaf", bt.MemPage.ph.flag)
+  }
+  if bt.MemPage.ph.pgno == oldRootPgno {
+    t.Fatal("root pgno unchanged; collapse never happened")
+  }
+  if _, ok := bt.hm[oldRootPgno]; ok {
+    t.Fatal("old root still in bt.hm after collapse; it should have been dropped alongside FreePage")
+  }
+}
+
+/*
+** Delete must free the cell's overflow chain, not just drop the cell:
+** otherwise those pages are never returned to the pager's freelist and a
+** later AllocatePage can't reuse them, growing the file forever.
+*/
+func TestCursorDeleteFreesOverflowChain(t *testing.T) {
+  path := t.TempDir() + "/test.db"
+  bt, err := Open(path, "memory", 128, JournalRollback)
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+
+  data := make([]byte, int(bt.maxLeaf)+200)
+  for i := range data {
+    data[i] = byte(i)
+  }
+  insertInt(t, bt, 1, string(data))
+
+  if bt.Pager.freelistHead != 0 {
+    t.Fatal("test setup: freelist should be empty before any delete")
+  }
+  nPageAllocBefore := bt.Pager.nPageAlloc
+
+  c := NewCursor(bt)
+  if found, err := c.Seek(1); err != nil || !found {
+    t.Fatalf("Seek(1): %v, %v", found, err)
+  }
+  if err := c.Delete(); err != nil {
+    t.Fatalf("Delete: %v", err)
+  }
+
+  if bt.Pager.freelistHead == 0 {
+    t.Fatal("Pager.freelistHead still 0 after deleting an overflowing payload; overflow chain was never freed")
+  }
+
+  insertInt(t, bt, 2, string(data))
+  if bt.Pager.nPageAlloc != nPageAllocBefore {
+    t.Fatalf("nPageAlloc grew from %d to %d; AllocatePage did not reuse a freed overflow page", nPageAllocBefore, bt.Pager.nPageAlloc)
+  }
+}
+
+/*
+** Delete must commit its own pager transaction and save the catalog the
+** same way Insert does -- otherwise its page mutations never reach
+** DirtyPages/disk and a reopen of the same path resurrects the deleted
+** key.
+*/
+func TestDeletePersistsAcrossReopen(t *testing.T) {
+  path := t.TempDir() + "/test.db"
+  bt1, err := Open(path, "memory", 4096, JournalRollback)
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+  for i := uint32(0); i < 10; i++ {
+    insertInt(t, bt1, i, "v")
+  }
+
+  c := NewCursor(bt1)
+  if found, err := c.Seek(5); err != nil || !found {
+    t.Fatalf("Seek(5) = %v, %v; want true, nil", found, err)
+  }
+  if err := c.Delete(); err != nil {
+    t.Fatalf("Delete: %v", err)
+  }
+
+  bt2, err := Open(path, "memory", 4096, JournalRollback)
+  if err != nil {
+    t.Fatalf("re-Open: %v", err)
+  }
+  found, err := NewCursor(bt2).Seek(5)
+  if err != nil {
+    t.Fatalf("Seek(5) after re-Open: %v", err)
+  }
+  if found {
+    t.Fatal("key 5 reappeared after reopen; Delete did not persist")
+  }
+}
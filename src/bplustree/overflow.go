@@ -0,0 +1,216 @@
+package bplustree
+
+import (
+  "encoding/binary"
+  "unsafe"
+)
+
+/* Bit 4 of the page header flags byte: this page is a link in an
+** overflow chain rather than a leaf/interior btree page. See the layout
+** comment on PageHeader in bplustree.go. No page is stamped with it:
+** writeOverflowChain writes only the next-pointer prefix described
+** below, and overflow pages get no MemPage or catalog entry. */
+const OVERFLOWPAGE = 4
+
+/* Every local payload is prefixed with the Pgno of the first overflow
+** page (0 if the payload fits entirely locally) and the total payload
+** length, so readPayload knows how many bytes to expect from the chain
+** without needing a separate index. */
+const payloadHdrSize = 4 + 4
+
+/* Every overflow page is prefixed with the Pgno of the next page in the
+** chain (0 for the last one); the rest of the page is payload bytes. */
+const overflowPtrSize = 4
+
+/*
+** cells returns pg's cell pointer array as a slice so callers can index
+** it directly instead of doing the unsafe.Pointer arithmetic themselves.
+*/
+func (pg *MemPage) cells() []Cell {
+  return unsafe.Slice((*Cell)(pg.cell), int(pg.ph.nCell))
+}
+
+/*
+** maxKey returns the largest key among pg's cells -- by the
+** cells()[i].key == max-key-of-child-i convention every interior cell
+** relies on, this is also the upper bound routed through pg as a whole.
+*/
+func (pg *MemPage) maxKey() uint32 {
+  cells := pg.cells()
+  return cells[len(cells)-1].key
+}
+
+/*
+** cellBuf returns the size bytes of page content starting at the byte
+** offset recorded in cells()[cellIdx].ptr. writePayload/readPayload use
+** it to reach the payload header and local bytes of a cell.
+*/
+func (pg *MemPage) cellBuf(cellIdx int, size int) []byte {
+  data := unsafe.Slice((*byte)(pg.aData), int(pg.pBt.usableSize))
+  off := int(pg.cells()[cellIdx].ptr)
+  return data[off : off+size]
+}
+
+/*
+** writePayload stores data as the payload of the cell at cellIdx on pg.
+** A payload up to pg.pBt.maxLeaf bytes is written entirely into the
+** cell's local space. A larger one keeps only pg.pBt.minLeaf bytes
+** locally and writes the remainder to a chain of OVERFLOWPAGE pages
+** allocated through pg.pBt.Pager -- this is what lets a posting list
+** (Payload.entrys) grow past a single page.
+*/
+func writePayload(pg *MemPage, cellIdx int, data []byte) error {
+  maxLeaf := int(pg.pBt.maxLeaf)
+  minLeaf := int(pg.pBt.minLeaf)
+
+  local := data
+  var overflow []byte
+  if len(data) > maxLeaf {
+    local = data[:minLeaf]
+    overflow = data[minLeaf:]
+  }
+
+  var head uint32
+  if len(overflow) > 0 {
+    pgno, err := writeOverflowChain(pg.pBt.Pager, overflow)
+    if err != nil {
+      return err
+    }
+    head = pgno
+  }
+
+  buf := pg.cellBuf(cellIdx, payloadHdrSize+len(local))
+  binary.BigEndian.PutUint32(buf[0:4], head)
+  binary.BigEndian.PutUint32(buf[4:8], uint32(len(data)))
+  copy(buf[payloadHdrSize:], local)
+  return nil
+}
+
+/*
+** readPayload reassembles the full payload of the cell at cellIdx on pg,
+** transparently walking its overflow chain (if any) through
+** pg.pBt.Pager.
+*/
+func readPayload(pg *MemPage, cellIdx int) ([]byte, error) {
+  minLeaf := int(pg.pBt.minLeaf)
+
+  hdr := pg.cellBuf(cellIdx, payloadHdrSize)
+  head := binary.BigEndian.Uint32(hdr[0:4])
+  total := int(binary.BigEndian.Uint32(hdr[4:8]))
+
+  localLen := total
+  if head != 0 {
+    localLen = minLeaf
+  }
+
+  raw := pg.cellBuf(cellIdx, payloadHdrSize+localLen)
+  out := make([]byte, 0, total)
+  out = append(out, raw[payloadHdrSize:payloadHdrSize+localLen]...)
+
+  for pgno := head; pgno != 0 && len(out) < total; {
+    next, chunk, err := readOverflowPage(pg.pBt.Pager, pgno)
+    if err != nil {
+      return nil, err
+    }
+    if need := total - len(out); need < len(chunk) {
+      chunk = chunk[:need]
+    }
+    out = append(out, chunk...)
+    pgno = next
+  }
+  return out, nil
+}
+
+/*
+** writeOverflowChain allocates and links as many OVERFLOWPAGE pages as
+** needed to hold data, returning the Pgno of the first one.
+*/
+func writeOverflowChain(pgr *Pager, data []byte) (uint32, error) {
+  usable := pgr.pageSize - overflowPtrSize
+
+  var head uint32
+  var prevPgno uint32
+  var prevBuf []byte
+  for len(data) > 0 {
+    pgno, pg, err := pgr.AllocatePage()
+    if err != nil {
+      return 0, err
+    }
+    if head == 0 {
+      head = pgno
+    }
+
+    n := len(data)
+    if n > usable {
+      n = usable
+    }
+    buf := unsafe.Slice(pg.pBuf, pgr.pageSize)
+    binary.BigEndian.PutUint32(buf[0:4], 0)
+    copy(buf[overflowPtrSize:], data[:n])
+    data = data[n:]
+    if err := pgr.WritePage(pg); err != nil {
+      return 0, err
+    }
+
+    if prevBuf != nil {
+      binary.BigEndian.PutUint32(prevBuf[0:4], pgno)
+    }
+    prevPgno, prevBuf = pgno, buf
+  }
+  _ = prevPgno
+  return head, nil
+}
+
+/*
+** readOverflowPage returns the Pgno of the next page in the chain (0 if
+** pgno is the last one) and a copy of pgno's payload bytes. The
+** reference ReadPage took is released before it returns.
+*/
+func readOverflowPage(pgr *Pager, pgno uint32) (uint32, []byte, error) {
+  pg, err := pgr.ReadPage(pgno)
+  if err != nil {
+    return 0, nil, err
+  }
+  buf := unsafe.Slice(pg.pBuf, pgr.pageSize)
+  next := binary.BigEndian.Uint32(buf[0:4])
+  chunk := make([]byte, len(buf)-overflowPtrSize)
+  copy(chunk, buf[overflowPtrSize:])
+  pgr.cache.Unpin(pg, true)
+  return next, chunk, nil
+}
+
+/*
+** overflowHead returns the Pgno of the cell at cellIdx's overflow chain
+** (0 if the payload fits entirely locally), the same header byte
+** readPayload parses to know whether it has a chain to walk.
+*/
+func overflowHead(pg *MemPage, cellIdx int) uint32 {
+  hdr := pg.cellBuf(cellIdx, payloadHdrSize)
+  return binary.BigEndian.Uint32(hdr[0:4])
+}
+
+/*
+** freeOverflowChain releases every page in the chain starting at head
+** back to pgr, the reverse of writeOverflowChain. Each page's next
+** pointer is read before FreePage overwrites it with freelist trunk
+** data, and the Fetch reference that read takes is dropped immediately
+** -- FreePage takes and releases its own -- so nothing is left pinned
+** for Pager.Commit's AssertNoRefs to trip over.
+*/
+func freeOverflowChain(pgr *Pager, head uint32) error {
+  for pgno := head; pgno != 0; {
+    pg, err := pgr.ReadPage(pgno)
+    if err != nil {
+      return err
+    }
+    buf := unsafe.Slice(pg.pBuf, pgr.pageSize)
+    next := binary.BigEndian.Uint32(buf[0:4])
+    pgr.cache.Unpin(pg, true)
+
+    if err := pgr.FreePage(pgno); err != nil {
+      return err
+    }
+    pgno = next
+  }
+  return nil
+}
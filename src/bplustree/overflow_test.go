@@ -0,0 +1,114 @@
+package bplustree
+
+import (
+  "bytes"
+  "testing"
+  "unsafe"
+)
+
+/*
+** A payload larger than bt.maxLeaf must round-trip through
+** writePayload/readPayload by spilling the remainder into a chain of
+** OVERFLOWPAGE pages and reassembling it on read.
+*/
+func TestWriteReadPayloadRoundTripsOverflow(t *testing.T) {
+  path := t.TempDir() + "/test.db"
+  bt, err := Open(path, "memory", 128, JournalRollback)
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+
+  if err := bt.Pager.Begin(); err != nil {
+    t.Fatalf("Begin: %v", err)
+  }
+  pg, err := bt.newPage(LEAFPAGE)
+  if err != nil {
+    t.Fatalf("newPage: %v", err)
+  }
+
+  data := bytes.Repeat([]byte("xyzzy-"), 50)
+  if len(data) <= int(bt.maxLeaf) {
+    t.Fatalf("test payload (%d bytes) must exceed maxLeaf (%d) to exercise overflow", len(data), bt.maxLeaf)
+  }
+
+  off := pg.allocSpace(bt.spaceNeeded(len(data)))
+  pg.appendCell(Cell{key: 1, ptr: uint32(off)})
+
+  if err := writePayload(pg, 0, data); err != nil {
+    t.Fatalf("writePayload: %v", err)
+  }
+
+  got, err := readPayload(pg, 0)
+  if err != nil {
+    t.Fatalf("readPayload: %v", err)
+  }
+  if !bytes.Equal(got, data) {
+    t.Fatalf("round trip mismatch: got %d bytes, want %d", len(got), len(data))
+  }
+}
+
+/*
+** readPayload must only read the bytes a cell actually has reserved
+** (payloadHdrSize+local, not payloadHdrSize+maxLeaf) -- otherwise it
+** slices past cells packed tightly behind a short payload, which a
+** small-pageSize run of ordinary inserts hits as soon as a leaf splits.
+*/
+func TestReadPayloadDoesNotOverreadShortLocalPayloads(t *testing.T) {
+  path := t.TempDir() + "/test.db"
+  bt, err := Open(path, "memory", 128, JournalRollback)
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+
+  for i := uint32(0); i < 14; i++ {
+    data := []byte{byte(i)}
+    pl := &Payload{key: i, size: uint16(len(data)), entrys: unsafe.Pointer(&data[0])}
+    if err := bt.Insert(pl); err != nil {
+      t.Fatalf("Insert(%d): %v", i, err)
+    }
+  }
+}
+
+/*
+** Every interior cell's key must track the largest key actually
+** reachable through its child: a split that leaves a stale or
+** wrongly-derived routing key behind makes Seek miss keys it never
+** touched, even though the insert itself raised no error. Enough
+** one-byte inserts at pageSize=128 to force several leaf splits (and at
+** least one more level of the tree) must all still be Seek-able
+** afterwards.
+*/
+func TestSeekFindsEveryKeyAfterRepeatedSplits(t *testing.T) {
+  path := t.TempDir() + "/test.db"
+  bt, err := Open(path, "memory", 128, JournalRollback)
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+
+  const n = 60
+  for i := uint32(0); i < n; i++ {
+    data := []byte{byte(i)}
+    pl := &Payload{key: i, size: uint16(len(data)), entrys: unsafe.Pointer(&data[0])}
+    if err := bt.Insert(pl); err != nil {
+      t.Fatalf("Insert(%d): %v", i, err)
+    }
+  }
+
+  c := NewCursor(bt)
+  for i := uint32(0); i < n; i++ {
+    found, err := c.Seek(int(i))
+    if err != nil {
+      t.Fatalf("Seek(%d): %v", i, err)
+    }
+    if !found {
+      t.Fatalf("Seek(%d): key not found", i)
+    }
+    got, err := c.Value()
+    if err != nil {
+      t.Fatalf("Value(%d): %v", i, err)
+    }
+    if len(got) != 1 || got[0] != byte(i) {
+      t.Fatalf("Value(%d) = %v, want [%d]", i, got, byte(i))
+    }
+  }
+}
@@ -0,0 +1,466 @@
+package bplustree
+
+import (
+  "encoding/binary"
+  "errors"
+  "io"
+  "os"
+  "unsafe"
+)
+
+/*
+** JournalMode selects how the Pager protects against a crash mid
+** transaction. JournalRollback keeps an undo log of page before-images in
+** a side "-journal" file and truncates it on commit. JournalWAL instead
+** appends new page images to a "-wal" file and lets readers find the
+** newest copy of a page through walIndex until a checkpoint folds the
+** frames back into the main database file.
+*/
+type JournalMode int
+
+const (
+  JournalRollback JournalMode = iota
+  JournalWAL
+)
+
+/*
+** Pager sits between BPlusTree and the OS. It owns the PageCache for the
+** database, turns ReadPage/WritePage into file I/O, and wraps a run of
+** writes in a transaction with Begin/Commit/Rollback using whichever
+** JournalMode the database was opened with. It is also what drives
+** PCache's xStress hook (cache.go), since flushing a dirty page to disk
+** is exactly what xStress needs done to make that page recyclable.
+*/
+type Pager struct {
+  cache PageCache
+  file *os.File
+  journalFile *os.File
+  walFile *os.File
+  journalPath string
+  walPath string
+  journalMode JournalMode
+  pageSize int
+  walIndex map[uint32]int64  /* pgno -> byte offset of its newest frame in walFile */
+  nWalFrame int
+  inTrans bool
+  journaled map[uint32]bool  /* Pages whose before-image is already in journalFile this txn */
+  nPageAlloc uint32          /* High-water mark of pages ever handed out by AllocatePage */
+  freelistHead uint32        /* Pgno of the first freelist trunk page, 0 if the freelist is empty */
+}
+
+/* freelistTrunkCap is the number of leaf page numbers a single freelist
+** trunk page can hold: the page minus its 4-byte next-trunk pointer and
+** 4-byte leaf count, divided into 4-byte Pgnos. */
+func (p *Pager) freelistTrunkCap() int {
+  return (p.pageSize - 8) / 4
+}
+
+/*
+** OpenPager opens (creating if necessary) the database file at path,
+** attaches a PageCache registered under cacheBackend, and prepares
+** whichever journal mode was requested. No transaction is open on
+** return.
+*/
+func OpenPager(path string, pageSize int, cacheBackend string, mode JournalMode) (*Pager, error) {
+  f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+  if err != nil {
+    return nil, err
+  }
+
+  pgr := &Pager{
+    cache:       newPageCache(cacheBackend),
+    file:        f,
+    journalPath: path + "-journal",
+    walPath:     path + "-wal",
+    journalMode: mode,
+    pageSize:    pageSize,
+    walIndex:    make(map[uint32]int64),
+  }
+  pgr.cache.Create(pageSize)
+  if memCache, ok := pgr.cache.(*PCache); ok {
+    memCache.xStress = pgr.flushPage
+  }
+
+  if fi, err := f.Stat(); err == nil {
+    pgr.nPageAlloc = uint32(fi.Size() / int64(pageSize))
+  }
+  return pgr, nil
+}
+
+/*
+** ReadPage returns the cached copy of pgno, reading it from the WAL (if
+** a frame for it exists there) or the main database file the first time
+** it is requested.
+*/
+func (p *Pager) ReadPage(pgno uint32) (*PgHdr, error) {
+  pg := p.cache.Fetch(int(pgno))
+  if pg.pBuf != nil {
+    return pg, nil
+  }
+
+  buf := make([]byte, p.pageSize)
+  if off, ok := p.walIndex[pgno]; ok {
+    if _, err := p.walFile.ReadAt(buf, off); err != nil && err != io.EOF {
+      return nil, err
+    }
+  } else {
+    off := int64(pgno-1) * int64(p.pageSize)
+    if _, err := p.file.ReadAt(buf, off); err != nil && err != io.EOF {
+      return nil, err
+    }
+  }
+  pg.pBuf = &buf[0]
+  pg.flags = PGHDR_CLEAN
+  return pg, nil
+}
+
+/*
+** WritePage marks pg dirty. In rollback mode the first write to a page
+** within a transaction copies its pre-write image into journalFile
+** before the page is allowed to change, so Rollback can restore it. WAL
+** mode needs no such copy -- the main file is never touched mid
+** transaction -- so the page is just flagged PGHDR_NEED_SYNC, meaning
+** "must not be written to the WAL ahead of the commit frame that covers
+** it", mirroring xStress's skip-if-NEED_SYNC rule in cache.go.
+*/
+func (p *Pager) WritePage(pg *PgHdr) error {
+  if !p.inTrans {
+    return errors.New("pager: WritePage called outside a transaction")
+  }
+
+  if p.journalMode == JournalRollback && !p.journaled[uint32(pg.iKey)] {
+    if err := p.journalPageImage(pg); err != nil {
+      return err
+    }
+    p.journaled[uint32(pg.iKey)] = true
+  } else if p.journalMode == JournalWAL {
+    pg.flags |= PGHDR_NEED_SYNC
+  }
+
+  if memCache, ok := p.cache.(*PCache); ok {
+    memCache.MakeDirty(pg)
+  } else {
+    pg.flags = (pg.flags &^ PGHDR_CLEAN) | PGHDR_DIRTY
+  }
+  return nil
+}
+
+/* journalPageImage appends pgno and the page's current on-disk image to
+** journalFile, opening it on first use. The image is read from the main
+** file, not from pg.pBuf, so it is the before-image even when the caller
+** has already modified pg.pBuf. */
+func (p *Pager) journalPageImage(pg *PgHdr) error {
+  if p.journalFile == nil {
+    jf, err := os.OpenFile(p.journalPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil {
+      return err
+    }
+    p.journalFile = jf
+  }
+  var hdr [4]byte
+  binary.BigEndian.PutUint32(hdr[:], uint32(pg.iKey))
+  if _, err := p.journalFile.Write(hdr[:]); err != nil {
+    return err
+  }
+  before := make([]byte, p.pageSize)
+  p.file.ReadAt(before, int64(pg.iKey-1)*int64(p.pageSize))
+  _, err := p.journalFile.Write(before)
+  return err
+}
+
+/*
+** Begin starts a transaction. Subsequent WritePage calls are protected by
+** whichever JournalMode the Pager was opened with until Commit or
+** Rollback ends the transaction.
+*/
+func (p *Pager) Begin() error {
+  if p.inTrans {
+    return errors.New("pager: transaction already open")
+  }
+  p.inTrans = true
+  p.journaled = make(map[uint32]bool)
+  return nil
+}
+
+/*
+** Commit flushes every dirty page to the main file or, in WAL mode,
+** appends them as new frames, then ends the transaction. Dirty pages are
+** discovered through PageCache.DirtyPages so this works the same way
+** under any registered backend, not just the default PCache (the
+** backend whose own dirty list MakeCleanAll also knows how to retire).
+** The rollback journal is truncated rather than deleted, matching the
+** SQLite convention of leaving a zero-length journal around as the
+** signal that there is nothing to roll back.
+*/
+func (p *Pager) Commit() error {
+  if !p.inTrans {
+    return errors.New("pager: Commit called outside a transaction")
+  }
+
+  memCache, ok := p.cache.(*PCache)
+  if ok {
+    memCache.AssertNoRefs()
+  }
+
+  for _, pg := range p.cache.DirtyPages() {
+    if err := p.flushPage(pg); err != nil {
+      return err
+    }
+  }
+
+  if ok {
+    memCache.MakeCleanAll()
+  } else {
+    for _, pg := range p.cache.DirtyPages() {
+      pg.flags = (pg.flags &^ uint16(PGHDR_DIRTY|PGHDR_NEED_SYNC|PGHDR_WRITEABLE)) | PGHDR_CLEAN
+    }
+  }
+
+  if p.journalMode == JournalWAL {
+    if err := p.walFile.Sync(); err != nil {
+      return err
+    }
+  } else if p.journalFile != nil {
+    if err := p.journalFile.Truncate(0); err != nil {
+      return err
+    }
+    if _, err := p.journalFile.Seek(0, io.SeekStart); err != nil {
+      return err
+    }
+  }
+
+  p.inTrans = false
+  p.journaled = nil
+  return nil
+}
+
+/*
+** Rollback discards every change made since Begin. In rollback-journal
+** mode the before-images written by WritePage are copied back over the
+** main file. In WAL mode nothing needs undoing on disk -- the main file
+** was never touched -- so it is enough to drop the frames this
+** transaction appended from walIndex.
+*/
+func (p *Pager) Rollback() error {
+  if !p.inTrans {
+    return errors.New("pager: Rollback called outside a transaction")
+  }
+
+  if p.journalMode == JournalRollback && p.journalFile != nil {
+    if _, err := p.journalFile.Seek(0, io.SeekStart); err != nil {
+      return err
+    }
+    hdr := make([]byte, 4)
+    page := make([]byte, p.pageSize)
+    for {
+      if _, err := io.ReadFull(p.journalFile, hdr); err != nil {
+        break
+      }
+      if _, err := io.ReadFull(p.journalFile, page); err != nil {
+        break
+      }
+      pgno := binary.BigEndian.Uint32(hdr)
+      if _, err := p.file.WriteAt(page, int64(pgno-1)*int64(p.pageSize)); err != nil {
+        return err
+      }
+    }
+    p.journalFile.Truncate(0)
+    p.journalFile.Seek(0, io.SeekStart)
+  } else {
+    for pgno := range p.journaled {
+      delete(p.walIndex, pgno)
+    }
+  }
+
+  if memCache, ok := p.cache.(*PCache); ok {
+    memCache.MakeCleanAll()
+  } else {
+    for _, pg := range p.cache.DirtyPages() {
+      pg.flags = (pg.flags &^ uint16(PGHDR_DIRTY|PGHDR_NEED_SYNC|PGHDR_WRITEABLE)) | PGHDR_CLEAN
+    }
+  }
+
+  p.inTrans = false
+  p.journaled = nil
+  return nil
+}
+
+/*
+** flushPage writes pg's current image to its durable home: appended as a
+** new WAL frame in WAL mode, or written in place in rollback mode (the
+** before-image protecting it is already sitting in journalFile). This is
+** the function wired up as PCache.xStress in OpenPager, and is also used
+** directly by Commit to flush the whole dirty list.
+*/
+func (p *Pager) flushPage(pg *PgHdr) error {
+  if pg.pBuf == nil {
+    return nil
+  }
+  buf := unsafe.Slice(pg.pBuf, p.pageSize)
+
+  if p.journalMode == JournalWAL {
+    if p.walFile == nil {
+      wf, err := os.OpenFile(p.walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+      if err != nil {
+        return err
+      }
+      p.walFile = wf
+    }
+    off, err := p.walFile.Seek(0, io.SeekEnd)
+    if err != nil {
+      return err
+    }
+    if _, err := p.walFile.Write(buf); err != nil {
+      return err
+    }
+    p.walIndex[uint32(pg.iKey)] = off
+    p.nWalFrame++
+    return nil
+  }
+
+  off := int64(pg.iKey-1) * int64(p.pageSize)
+  _, err := p.file.WriteAt(buf, off)
+  return err
+}
+
+/*
+** AllocatePage hands out a page number the caller may fill in and write
+** with WritePage -- for example, a link in an overflow chain (see
+** overflow.go) or a btree page freed by a Cursor.Delete rebalance and
+** now being reused. It prefers popping a page off the freelist (see
+** FreePage) over growing the database file. The returned page is fetched
+** through the cache like any other so the caller can write into pg.pBuf
+** directly, as writeOverflowChain does. AllocatePage releases the Fetch
+** reference it took itself (reuse=true: the page stays cached, only its
+** pin is dropped) instead of leaving it outstanding for Pager.Commit's
+** AssertNoRefs to trip over; a caller that keeps the page, like
+** BPlusTree.newPage, re-fetches it to hold a reference of its own. Popping a leaf off a trunk
+** edits that trunk's own leaf count in place, so that edit goes through
+** WritePage like any other page mutation -- otherwise it would never
+** reach DirtyPages and Commit would never flush it.
+*/
+func (p *Pager) AllocatePage() (uint32, *PgHdr, error) {
+  if p.freelistHead != 0 {
+    trunk, err := p.ReadPage(p.freelistHead)
+    if err != nil {
+      return 0, nil, err
+    }
+    tbuf := unsafe.Slice(trunk.pBuf, p.pageSize)
+    n := binary.BigEndian.Uint32(tbuf[4:8])
+
+    if n > 0 {
+      off := 8 + 4*(n-1)
+      pgno := binary.BigEndian.Uint32(tbuf[off : off+4])
+      binary.BigEndian.PutUint32(tbuf[4:8], n-1)
+      if err := p.WritePage(trunk); err != nil {
+        return 0, nil, err
+      }
+      p.cache.Unpin(trunk, true)
+      pg, err := p.ReadPage(pgno)
+      if err != nil {
+        return 0, nil, err
+      }
+      buf := make([]byte, p.pageSize)
+      pg.pBuf = &buf[0]
+      p.cache.Unpin(pg, true)
+      return pgno, pg, nil
+    }
+
+    /* This trunk page is itself empty: hand it out and promote the
+    ** trunk it points to (if any) to be the new freelist head. */
+    pgno := p.freelistHead
+    p.freelistHead = binary.BigEndian.Uint32(tbuf[0:4])
+    buf := make([]byte, p.pageSize)
+    trunk.pBuf = &buf[0]
+    p.cache.Unpin(trunk, true)
+    return pgno, trunk, nil
+  }
+
+  p.nPageAlloc++
+  pgno := p.nPageAlloc
+  pg, err := p.ReadPage(pgno)
+  if err != nil {
+    return 0, nil, err
+  }
+  buf := make([]byte, p.pageSize)
+  pg.pBuf = &buf[0]
+  p.cache.Unpin(pg, true)
+  return pgno, pg, nil
+}
+
+/*
+** FreePage releases pgno back to the Pager so a later AllocatePage can
+** reuse it instead of growing the file. Released pages are recorded on a
+** chain of freelist trunk pages (mirroring SQLite's on-disk freelist). The
+** head of that chain is kept only in p.freelistHead, which OpenPager does
+** not restore, so a reopened Pager starts with an empty freelist. The
+** first leaf pgno is appended to the current trunk if it still has room,
+** otherwise pgno itself becomes a new trunk pointing at the old one. Like
+** AllocatePage, it releases every Fetch reference it takes along the way
+** so Pager.Commit's AssertNoRefs doesn't see it as a leak. Every trunk
+** page it writes into -- appending a leaf or becoming a new trunk -- goes
+** through WritePage so the edit lands in DirtyPages for Commit to flush.
+*/
+func (p *Pager) FreePage(pgno uint32) error {
+  if p.freelistHead != 0 {
+    trunk, err := p.ReadPage(p.freelistHead)
+    if err != nil {
+      return err
+    }
+    tbuf := unsafe.Slice(trunk.pBuf, p.pageSize)
+    n := binary.BigEndian.Uint32(tbuf[4:8])
+    if int(n) < p.freelistTrunkCap() {
+      off := 8 + 4*n
+      binary.BigEndian.PutUint32(tbuf[off:off+4], pgno)
+      binary.BigEndian.PutUint32(tbuf[4:8], n+1)
+      if err := p.WritePage(trunk); err != nil {
+        return err
+      }
+      p.cache.Unpin(trunk, true)
+      return nil
+    }
+    p.cache.Unpin(trunk, true)
+  }
+
+  pg, err := p.ReadPage(pgno)
+  if err != nil {
+    return err
+  }
+  buf := make([]byte, p.pageSize)
+  binary.BigEndian.PutUint32(buf[0:4], p.freelistHead)
+  binary.BigEndian.PutUint32(buf[4:8], 0)
+  pg.pBuf = &buf[0]
+  if err := p.WritePage(pg); err != nil {
+    return err
+  }
+  p.cache.Unpin(pg, true)
+  p.freelistHead = pgno
+  return nil
+}
+
+/*
+** Checkpoint copies every frame currently in the WAL back into the main
+** database file, in no particular pgno order (walIndex is a map), and
+** truncates the WAL. Readers that have
+** already cached a page via ReadPage are unaffected since walIndex (not
+** the file offset of the main database) is their source of truth while a
+** checkpoint has not yet run.
+*/
+func (p *Pager) Checkpoint() error {
+  if p.journalMode != JournalWAL || p.walFile == nil {
+    return nil
+  }
+  for pgno, off := range p.walIndex {
+    buf := make([]byte, p.pageSize)
+    if _, err := p.walFile.ReadAt(buf, off); err != nil && err != io.EOF {
+      return err
+    }
+    dst := int64(pgno-1) * int64(p.pageSize)
+    if _, err := p.file.WriteAt(buf, dst); err != nil {
+      return err
+    }
+    delete(p.walIndex, pgno)
+  }
+  p.nWalFrame = 0
+  return p.walFile.Truncate(0)
+}
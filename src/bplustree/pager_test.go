@@ -0,0 +1,154 @@
+package bplustree
+
+import (
+  "encoding/binary"
+  "os"
+  "testing"
+  "unsafe"
+)
+
+/*
+** A committed write must land on disk (after a Checkpoint, in WAL
+** mode); a write that is rolled back in JournalRollback mode must leave
+** the file exactly as it was before Begin.
+*/
+func TestPagerCommitAndRollback(t *testing.T) {
+  for _, mode := range []JournalMode{JournalRollback, JournalWAL} {
+    path := t.TempDir() + "/test.db"
+    pgr, err := OpenPager(path, 64, "memory", mode)
+    if err != nil {
+      t.Fatalf("%v: OpenPager: %v", mode, err)
+    }
+
+    if err := pgr.Begin(); err != nil {
+      t.Fatalf("%v: Begin: %v", mode, err)
+    }
+    pgno, pg, err := pgr.AllocatePage()
+    if err != nil {
+      t.Fatalf("%v: AllocatePage: %v", mode, err)
+    }
+    unsafe.Slice(pg.pBuf, 64)[0] = 0xAB
+    if err := pgr.WritePage(pg); err != nil {
+      t.Fatalf("%v: WritePage: %v", mode, err)
+    }
+    // AllocatePage already released its own Fetch reference; nothing left to Unpin here.
+    if err := pgr.Commit(); err != nil {
+      t.Fatalf("%v: Commit: %v", mode, err)
+    }
+    if mode == JournalWAL {
+      if err := pgr.Checkpoint(); err != nil {
+        t.Fatalf("%v: Checkpoint: %v", mode, err)
+      }
+    }
+
+    onDisk := make([]byte, 64)
+    f, err := os.Open(path)
+    if err != nil {
+      t.Fatalf("%v: Open: %v", mode, err)
+    }
+    if _, err := f.ReadAt(onDisk, int64(pgno-1)*64); err != nil {
+      t.Fatalf("%v: ReadAt: %v", mode, err)
+    }
+    f.Close()
+    if onDisk[0] != 0xAB {
+      t.Fatalf("%v: committed byte not on disk, got %#x", mode, onDisk[0])
+    }
+
+    if mode != JournalRollback {
+      continue
+    }
+
+    if err := pgr.Begin(); err != nil {
+      t.Fatalf("%v: Begin: %v", mode, err)
+    }
+    pg2, err := pgr.ReadPage(pgno)
+    if err != nil {
+      t.Fatalf("%v: ReadPage: %v", mode, err)
+    }
+    unsafe.Slice(pg2.pBuf, 64)[0] = 0xCD
+    if err := pgr.WritePage(pg2); err != nil {
+      t.Fatalf("%v: WritePage: %v", mode, err)
+    }
+    pgr.cache.Unpin(pg2, true)
+    if err := pgr.Rollback(); err != nil {
+      t.Fatalf("%v: Rollback: %v", mode, err)
+    }
+
+    f, err = os.Open(path)
+    if err != nil {
+      t.Fatalf("%v: Open: %v", mode, err)
+    }
+    f.ReadAt(onDisk, int64(pgno-1)*64)
+    f.Close()
+    if onDisk[0] != 0xAB {
+      t.Fatalf("%v: rollback did not restore the pre-image, got %#x", mode, onDisk[0])
+    }
+  }
+}
+
+/*
+** FreePage's edits to a freelist trunk page -- becoming a trunk, then
+** appending a leaf to one -- must go through WritePage like any other
+** page mutation, or they never reach DirtyPages and Commit never
+** flushes them: evicting the trunk from cache and reading it back from
+** disk would otherwise show the free as having never happened.
+*/
+func TestFreePagePersistsAcrossEviction(t *testing.T) {
+  path := t.TempDir() + "/test.db"
+  pgr, err := OpenPager(path, 64, "memory", JournalRollback)
+  if err != nil {
+    t.Fatalf("OpenPager: %v", err)
+  }
+
+  if err := pgr.Begin(); err != nil {
+    t.Fatalf("Begin: %v", err)
+  }
+  var pgnos []uint32
+  for i := 0; i < 3; i++ {
+    pgno, pg, err := pgr.AllocatePage()
+    if err != nil {
+      t.Fatalf("AllocatePage: %v", err)
+    }
+    if err := pgr.WritePage(pg); err != nil {
+      t.Fatalf("WritePage: %v", err)
+    }
+    pgnos = append(pgnos, pgno)
+  }
+  if err := pgr.Commit(); err != nil {
+    t.Fatalf("Commit: %v", err)
+  }
+
+  if err := pgr.Begin(); err != nil {
+    t.Fatalf("Begin: %v", err)
+  }
+  // pgnos[2] becomes the freelist's first trunk; pgnos[1] is then
+  // appended to it as a leaf.
+  if err := pgr.FreePage(pgnos[2]); err != nil {
+    t.Fatalf("FreePage(%d): %v", pgnos[2], err)
+  }
+  if err := pgr.FreePage(pgnos[1]); err != nil {
+    t.Fatalf("FreePage(%d): %v", pgnos[1], err)
+  }
+  if err := pgr.Commit(); err != nil {
+    t.Fatalf("Commit: %v", err)
+  }
+
+  pgr.cache.SetCacheSize(1)
+  for pgno := uint32(1000); pgno < 1010; pgno++ {
+    if _, err := pgr.ReadPage(pgno); err != nil {
+      t.Fatalf("unrelated ReadPage(%d): %v", pgno, err)
+    }
+  }
+
+  trunk, err := pgr.ReadPage(pgnos[2])
+  if err != nil {
+    t.Fatalf("ReadPage(trunk=%d): %v", pgnos[2], err)
+  }
+  tbuf := unsafe.Slice(trunk.pBuf, 64)
+  if n := binary.BigEndian.Uint32(tbuf[4:8]); n != 1 {
+    t.Fatalf("trunk leaf count = %d, want 1; the free did not survive eviction", n)
+  }
+  if leaf := binary.BigEndian.Uint32(tbuf[8:12]); leaf != pgnos[1] {
+    t.Fatalf("trunk leaf = %d, want %d", leaf, pgnos[1])
+  }
+}
@@ -0,0 +1,86 @@
+package bplustree
+
+/*
+** PageCache is the interface a Pager uses to manage the in-memory copies
+** of database pages. A PageCache implementation owns the page buffers for
+** a single open database; the hash+LRU implementation in cache.go is the
+** default provider, registered below under the name "memory".
+**
+** Applications that want a different eviction policy, or that want pages
+** backed by mmap'd or off-heap memory, can implement PageCache themselves
+** and make it available with Register() before the database is opened.
+*/
+type PageCache interface {
+  /* Create allocates the cache's internal structures for pages of szPage
+  ** bytes each. */
+  Create(szPage int)
+
+  /* Fetch returns the page numbered iKey, creating and pinning a new one
+  ** if it is not already present. */
+  Fetch(iKey int) *PgHdr
+
+  /* Unpin releases a reference obtained from Fetch. If reuse is false the
+  ** page is discarded outright instead of being placed on the LRU list. */
+  Unpin(p *PgHdr, reuse bool)
+
+  /* Rekey changes the page number of a cached page from iOld to iNew,
+  ** discarding any page already cached under iNew. */
+  Rekey(p *PgHdr, iOld int, iNew int)
+
+  /* Truncate discards every page with iKey >= iLimit. */
+  Truncate(iLimit int)
+
+  /* Destroy releases all resources owned by the cache. The cache must not
+  ** be used again afterwards. */
+  Destroy()
+
+  /* PageCount returns the number of pages currently held by the cache. */
+  PageCount() int
+
+  /* Shrink releases as much memory as possible back to the OS without
+  ** discarding any page the cache is still responsible for. */
+  Shrink()
+
+  /* SetCacheSize configures the "cache_size" value: the number of pages
+  ** the cache may hold before Fetch starts recycling. */
+  SetCacheSize(nMax int)
+
+  /* DirtyPages returns every page currently marked dirty. The Pager's
+  ** Commit/Rollback (pager.go) flush and clean this list directly, so
+  ** every backend -- not just the default hash+LRU one -- can
+  ** participate in a transaction. */
+  DirtyPages() []*PgHdr
+}
+
+/* pcacheFactory returns a new, empty PageCache instance. */
+type pcacheFactory func() PageCache
+
+var pcacheRegistry = map[string]pcacheFactory{}
+
+/*
+** Register makes a PageCache implementation available under name so that
+** BPlusTree.Open can select it by name. Registering the same name twice
+** replaces the previously registered factory.
+*/
+func Register(name string, factory pcacheFactory) {
+  pcacheRegistry[name] = factory
+}
+
+/*
+** newPageCache looks up name in the registry and returns a fresh,
+** uninitialized PageCache. It panics if name was never registered -- this
+** mirrors a misconfigured build in the C sources, not a runtime condition
+** callers are expected to recover from.
+*/
+func newPageCache(name string) PageCache {
+  factory, ok := pcacheRegistry[name]
+  if !ok {
+    panic("bplustree: no PageCache backend registered as " + name)
+  }
+  return factory()
+}
+
+func init() {
+  Register("memory", func() PageCache { return &PCache{} })
+  Register("lru2", func() PageCache { return &LRU2Cache{} })
+}
@@ -0,0 +1,191 @@
+package bplustree
+
+/*
+** lru2Entry augments a PgHdr with the extra bookkeeping an LRU-2 policy
+** needs: how many times the page has been fetched. A page moves from the
+** cold list to the hot list the second time it is fetched, so a single
+** sequential scan of cold pages cannot evict pages that are genuinely
+** being reused -- the scan resistance a plain LRU cache (see cache.go)
+** does not have.
+*/
+type lru2Entry struct {
+  page *PgHdr
+  nHit int
+}
+
+/*
+** LRU2Cache is the second PageCache provider shipped alongside the
+** default hash+LRU one in cache.go. It keeps two queues, cold and hot,
+** both ordered oldest-first; Fetch promotes an entry into hot the moment
+** it is seen a second time, and eviction always drains cold before it
+** touches hot.
+*/
+type LRU2Cache struct {
+  szPage int
+  nMax int
+  byKey map[int]*lru2Entry
+  cold []*lru2Entry
+  hot []*lru2Entry
+}
+
+/*
+** Implementation of the Create method.
+**
+** Allocate a new cache.
+*/
+func (c *LRU2Cache) Create(szPage int) {
+  c.szPage = szPage
+  c.byKey = make(map[int]*lru2Entry)
+}
+
+func (c *LRU2Cache) Fetch(iKey int) *PgHdr {
+  if e, ok := c.byKey[iKey]; ok {
+    e.nHit++
+    c.promote(e)
+    e.page.nRef++
+    return e.page
+  }
+
+  if c.nMax > 0 && len(c.byKey) >= c.nMax {
+    c.evictOne()
+  }
+
+  page := &PgHdr{iKey: iKey, nRef: 1}
+  e := &lru2Entry{page: page, nHit: 1}
+  c.byKey[iKey] = e
+  c.cold = append(c.cold, e)
+  return page
+}
+
+/* promote moves e from the cold queue to the back of the hot queue once
+** it has been hit twice; a cold page that is hit only once is left where
+** it is, since re-appending it would defeat scan resistance. */
+func (c *LRU2Cache) promote(e *lru2Entry) {
+  if e.nHit < 2 {
+    return
+  }
+  for i, it := range c.cold {
+    if it == e {
+      c.cold = append(c.cold[:i], c.cold[i+1:]...)
+      break
+    }
+  }
+  for i, it := range c.hot {
+    if it == e {
+      c.hot = append(c.hot[:i], c.hot[i+1:]...)
+      break
+    }
+  }
+  c.hot = append(c.hot, e)
+}
+
+/* evictOne discards the oldest unreferenced, clean cold entry, or the
+** oldest unreferenced, clean hot entry if cold has none to offer,
+** skipping over any entry whose nRef is still nonzero -- the same "only
+** unpinned pages are ever recycled" invariant PCache.Fetch's LRU-tail
+** steal relies on (see cache.go) -- and skipping PGHDR_DIRTY entries for
+** the same reason PCache never links a dirty page onto its purgeable
+** LRU list: evicting one here would silently drop an uncommitted write
+** instead of flushing it. It reports whether it found anything to
+** evict, since a cache where every entry is currently held by a caller
+** or dirty has nothing evictable at all. */
+func (c *LRU2Cache) evictOne() bool {
+  for i, e := range c.cold {
+    if e.page.nRef == 0 && e.page.flags & PGHDR_DIRTY == 0 {
+      c.cold = append(c.cold[:i], c.cold[i+1:]...)
+      delete(c.byKey, e.page.iKey)
+      return true
+    }
+  }
+  for i, e := range c.hot {
+    if e.page.nRef == 0 && e.page.flags & PGHDR_DIRTY == 0 {
+      c.hot = append(c.hot[:i], c.hot[i+1:]...)
+      delete(c.byKey, e.page.iKey)
+      return true
+    }
+  }
+  return false
+}
+
+func (c *LRU2Cache) Unpin(p *PgHdr, reuse bool) {
+  p.nRef--
+  if reuse {
+    return
+  }
+  e, ok := c.byKey[p.iKey]
+  if !ok {
+    return
+  }
+  delete(c.byKey, p.iKey)
+  for i, it := range c.cold {
+    if it == e {
+      c.cold = append(c.cold[:i], c.cold[i+1:]...)
+      return
+    }
+  }
+  for i, it := range c.hot {
+    if it == e {
+      c.hot = append(c.hot[:i], c.hot[i+1:]...)
+      return
+    }
+  }
+}
+
+func (c *LRU2Cache) Rekey(p *PgHdr, iOld int, iNew int) {
+  if old, ok := c.byKey[iNew]; ok {
+    c.Unpin(old.page, false)
+  }
+  e, ok := c.byKey[iOld]
+  if !ok {
+    return
+  }
+  delete(c.byKey, iOld)
+  p.iKey = iNew
+  c.byKey[iNew] = e
+}
+
+func (c *LRU2Cache) Truncate(iLimit int) {
+  for iKey := range c.byKey {
+    if iKey >= iLimit {
+      c.Unpin(c.byKey[iKey].page, false)
+    }
+  }
+}
+
+func (c *LRU2Cache) Destroy() {
+  c.byKey = nil
+  c.cold = nil
+  c.hot = nil
+}
+
+func (c *LRU2Cache) PageCount() int {
+  return len(c.byKey)
+}
+
+func (c *LRU2Cache) Shrink() {
+  for len(c.byKey) > c.nMax && c.nMax > 0 {
+    if !c.evictOne() {
+      break
+    }
+  }
+}
+
+func (c *LRU2Cache) SetCacheSize(nMax int) {
+  c.nMax = nMax
+}
+
+/*
+** DirtyPages scans both queues for pages flagged PGHDR_DIRTY. LRU2Cache
+** keeps no separate dirty list of its own the way PCache does, so this
+** is an O(n) sweep rather than a list walk -- acceptable since it only
+** runs once per Commit/Rollback.
+*/
+func (c *LRU2Cache) DirtyPages() []*PgHdr {
+  var out []*PgHdr
+  for _, e := range c.byKey {
+    if e.page.flags & PGHDR_DIRTY != 0 {
+      out = append(out, e.page)
+    }
+  }
+  return out
+}
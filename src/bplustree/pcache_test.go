@@ -0,0 +1,91 @@
+package bplustree
+
+import "testing"
+
+func TestRegisteredBackendsFetchAndCount(t *testing.T) {
+  for _, name := range []string{"memory", "lru2"} {
+    cache := newPageCache(name)
+    cache.Create(256)
+
+    pg := cache.Fetch(1)
+    if pg == nil {
+      t.Fatalf("%s: Fetch returned nil", name)
+    }
+    if got := cache.PageCount(); got != 1 {
+      t.Fatalf("%s: PageCount() = %d, want 1", name, got)
+    }
+    cache.Unpin(pg, false)
+  }
+}
+
+/*
+** LRU2Cache.evictOne must not recycle an entry that is still Ref'd:
+** Fetch(1) leaves its caller holding a reference, so a later Fetch(2)
+** against a cache capped at one page must not steal page 1 out from
+** under it.
+*/
+func TestLRU2EvictOneSkipsReferencedEntries(t *testing.T) {
+  cache := newPageCache("lru2")
+  cache.Create(256)
+  cache.SetCacheSize(1)
+
+  pg1 := cache.Fetch(1)
+  if pg1 == nil {
+    t.Fatal("Fetch(1) returned nil")
+  }
+
+  pg2 := cache.Fetch(2)
+  if pg2 == nil {
+    t.Fatal("Fetch(2) returned nil")
+  }
+
+  if got := cache.PageCount(); got != 2 {
+    t.Fatalf("PageCount() = %d, want 2; page 1 was evicted while still referenced", got)
+  }
+  if pg1.nRef != 1 {
+    t.Fatalf("pg1.nRef = %d, want 1; evictOne touched a referenced page", pg1.nRef)
+  }
+}
+
+/*
+** LRU2Cache.evictOne must not recycle a dirty entry either, even once
+** its last reference is gone: Fetch(1) then Unpin(reuse=true) leaves
+** page 1 unreferenced but still PGHDR_DIRTY, and a later Fetch(2)
+** against a cache capped at one page must not silently drop that
+** uncommitted write to make room.
+*/
+func TestLRU2EvictOneSkipsDirtyEntries(t *testing.T) {
+  cache := newPageCache("lru2")
+  cache.Create(256)
+  cache.SetCacheSize(1)
+
+  pg1 := cache.Fetch(1)
+  if pg1 == nil {
+    t.Fatal("Fetch(1) returned nil")
+  }
+  pg1.flags |= PGHDR_DIRTY
+  cache.Unpin(pg1, true)
+
+  pg2 := cache.Fetch(2)
+  if pg2 == nil {
+    t.Fatal("Fetch(2) returned nil")
+  }
+
+  if got := cache.PageCount(); got != 2 {
+    t.Fatalf("PageCount() = %d, want 2; dirty page 1 was evicted to make room", got)
+  }
+}
+
+func TestRegisterReplacesFactory(t *testing.T) {
+  called := false
+  Register("memory", func() PageCache {
+    called = true
+    return &PCache{}
+  })
+  defer Register("memory", func() PageCache { return &PCache{} })
+
+  newPageCache("memory")
+  if !called {
+    t.Fatal("Register did not replace the \"memory\" factory")
+  }
+}
@@ -0,0 +1,153 @@
+package bplustree
+
+import (
+  "encoding/binary"
+  "errors"
+  "io"
+  "os"
+  "unsafe"
+)
+
+/*
+** Pager.WritePage durably records a page's content bytes (the payload
+** area cellBuf/readPayload/writePayload work in), but the structural
+** half of the tree -- which pgno is the root, and each page's flag,
+** parent and cell pointer array -- only ever lived in bt.hm's MemPage
+** structs. saveCatalog/loadCatalog are what let that survive a reopen:
+** saveCatalog snapshots bt.hm to bt.catalogPath after every commit, and
+** Open's loadCatalog reads it back, faulting each page's buffer back in
+** through bt.Pager.ReadPage instead of leaving bt.hm empty.
+*/
+
+/* catalogCellSize is the on-disk width of one serialized Cell: a Pgno
+** or content offset (ptr) and a key, both uint32. */
+const catalogCellSize = 8
+
+/*
+** saveCatalog overwrites bt.catalogPath with bt's current root pgno,
+** page count, and every resident page's header fields and cell array.
+** It is called by Insert once a transaction has committed, so the
+** catalog on disk never describes a state the main file hasn't also
+** reached.
+*/
+func (bt *BPlusTree) saveCatalog() error {
+  f, err := os.OpenFile(bt.catalogPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  var rootPgno uint32
+  if bt.MemPage != nil {
+    rootPgno = bt.MemPage.ph.pgno
+  }
+
+  hdr := make([]byte, 12)
+  binary.BigEndian.PutUint32(hdr[0:4], rootPgno)
+  binary.BigEndian.PutUint32(hdr[4:8], bt.nPage)
+  binary.BigEndian.PutUint32(hdr[8:12], uint32(len(bt.hm)))
+  if _, err := f.Write(hdr); err != nil {
+    return err
+  }
+
+  for pgno, pg := range bt.hm {
+    entry := make([]byte, 13)
+    binary.BigEndian.PutUint32(entry[0:4], pgno)
+    entry[4] = pg.ph.flag
+    binary.BigEndian.PutUint16(entry[5:7], pg.ph.nCell)
+    binary.BigEndian.PutUint16(entry[7:9], pg.ph.freeOffset)
+    binary.BigEndian.PutUint32(entry[9:13], pg.ph.parent)
+    if _, err := f.Write(entry); err != nil {
+      return err
+    }
+
+    cells := pg.cells()
+    cellBytes := make([]byte, len(cells)*catalogCellSize)
+    for i, c := range cells {
+      off := i * catalogCellSize
+      binary.BigEndian.PutUint32(cellBytes[off:off+4], c.ptr)
+      binary.BigEndian.PutUint32(cellBytes[off+4:off+8], c.key)
+    }
+    if _, err := f.Write(cellBytes); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+/*
+** loadCatalog reads bt.catalogPath (written by saveCatalog) and rebuilds
+** bt.hm: one MemPage per recorded page, backed by the real page buffer
+** faulted in through bt.Pager.ReadPage rather than a freshly zeroed one.
+** It is a no-op, leaving bt the empty tree Open already built, if
+** catalogPath doesn't exist -- i.e. path has never been committed to.
+*/
+func (bt *BPlusTree) loadCatalog() error {
+  f, err := os.Open(bt.catalogPath)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  hdr := make([]byte, 12)
+  if _, err := io.ReadFull(f, hdr); err != nil {
+    return err
+  }
+  rootPgno := binary.BigEndian.Uint32(hdr[0:4])
+  nPage := binary.BigEndian.Uint32(hdr[4:8])
+  count := binary.BigEndian.Uint32(hdr[8:12])
+
+  maxCells := int(bt.usableSize) / int(unsafe.Sizeof(Cell{}))
+
+  for i := uint32(0); i < count; i++ {
+    entry := make([]byte, 13)
+    if _, err := io.ReadFull(f, entry); err != nil {
+      return err
+    }
+    pgno := binary.BigEndian.Uint32(entry[0:4])
+    flag := entry[4]
+    nCell := binary.BigEndian.Uint16(entry[5:7])
+    freeOffset := binary.BigEndian.Uint16(entry[7:9])
+    parent := binary.BigEndian.Uint32(entry[9:13])
+
+    cellBytes := make([]byte, int(nCell)*catalogCellSize)
+    if _, err := io.ReadFull(f, cellBytes); err != nil {
+      return err
+    }
+    cells := make([]Cell, maxCells)
+    for j := 0; j < int(nCell); j++ {
+      off := j * catalogCellSize
+      cells[j] = Cell{
+        ptr: binary.BigEndian.Uint32(cellBytes[off : off+4]),
+        key: binary.BigEndian.Uint32(cellBytes[off+4 : off+8]),
+      }
+    }
+
+    /* ReadPage leaves pgHdr Ref'd; that reference is what keeps this
+    ** page resident once Open returns, same as newPage's for a freshly
+    ** allocated one -- see BPlusTree.commit. */
+    pgHdr, err := bt.Pager.ReadPage(pgno)
+    if err != nil {
+      return err
+    }
+    data := unsafe.Slice(pgHdr.pBuf, int(bt.usableSize))
+
+    pg := &MemPage{
+      ph:    &PageHeader{flag: flag, freeOffset: freeOffset, nCell: nCell, pgno: pgno, parent: parent},
+      pgHdr: pgHdr,
+      aData: unsafe.Pointer(&data[0]),
+      cell:  unsafe.Pointer(&cells[0]),
+      pBt:   bt,
+    }
+    bt.hm[pgno] = pg
+  }
+
+  bt.nPage = nPage
+  if root, ok := bt.hm[rootPgno]; ok {
+    bt.MemPage = root
+  }
+  return nil
+}
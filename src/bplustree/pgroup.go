@@ -0,0 +1,155 @@
+package bplustree
+
+import (
+  "sync"
+)
+
+/*
+** A PGroup is a set of one or more PCaches that all share a single page
+** LRU list and a single mutex. Most applications open one database per
+** process and so have only a single PCache per PGroup, but the design
+** (mirrored from the external pcache sources) allows several PCache
+** instances -- for example, several attached databases in one connection
+** -- to compete for the same block of cache memory.
+**
+** lru is a sentinel PgHdr; lru.pLruNext is the most-recently-used end of
+** the list and lru.pLruPrev is the least-recently-used end, the end
+** Fetch steals from when a cache needs to recycle a page.
+*/
+type PGroup struct {
+  mu sync.Mutex
+  lru PgHdr
+  nMaxPage int   /* Sum of nMax over attached caches: suggested cache size */
+  nMinPage int   /* Sum of nMin over attached caches: minimum reserved pages */
+}
+
+/*
+** NewPGroup returns a freshly initialized, empty PGroup ready to have
+** PCache instances attached to it with Attach.
+*/
+func NewPGroup() *PGroup {
+  g := &PGroup{}
+  g.lru.pLruNext = &g.lru
+  g.lru.pLruPrev = &g.lru
+  return g
+}
+
+/*
+** Attach makes pCache a member of the group, folding its nMin/nMax into
+** the group totals nMinPage/nMaxPage. Nothing reads those totals: whether
+** a foreign cache may steal one of pCache's pages is decided by
+** findVictim from pCache's own nMin and nPurgeable.
+*/
+func (g *PGroup) Attach(pCache *PCache) {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  pCache.pGroup = g
+  g.nMaxPage += pCache.nMax
+  g.nMinPage += pCache.nMin
+}
+
+/* linkTail places p at the most-recently-used end of the LRU list. The
+** caller must hold g.mu. */
+func (g *PGroup) linkTail(p *PgHdr) {
+  p.pLruNext = g.lru.pLruNext
+  p.pLruPrev = &g.lru
+  g.lru.pLruNext.pLruPrev = p
+  g.lru.pLruNext = p
+}
+
+/* unlink removes p from the LRU list it currently sits on, if any, and
+** reports whether p was actually linked. The caller must hold g.mu. */
+func (g *PGroup) unlink(p *PgHdr) bool {
+  if p.pLruNext == nil && p.pLruPrev == nil {
+    return false
+  }
+  p.pLruPrev.pLruNext = p.pLruNext
+  p.pLruNext.pLruPrev = p.pLruPrev
+  p.pLruNext = nil
+  p.pLruPrev = nil
+  return true
+}
+
+/*
+** Pin removes p from the group LRU list, marking it as in-use and no
+** longer a candidate for recycling by any cache in the group. nPurgeable
+** only moves if p was actually sitting on the list -- a page Fetch found
+** already dirty, for example, was never linked in the first place (see
+** MakeDirty), and PCache.Unpin calls Pin unconditionally on every last
+** Unref regardless of whether Unref's own Unpin call added it.
+*/
+func (g *PGroup) Pin(p *PgHdr) {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  if g.unlink(p) && p.pCache != nil {
+    p.pCache.nPurgeable--
+  }
+}
+
+/*
+** Unpin places p at the most-recently-used end of the group LRU list,
+** making it the last page any cache in the group will recycle.
+*/
+func (g *PGroup) Unpin(p *PgHdr) {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  g.linkTail(p)
+  if p.pCache != nil {
+    p.pCache.nPurgeable++
+  }
+}
+
+/*
+** findVictim walks the group LRU list from its least-recently-used end
+** looking for a page requester may steal: one belonging to requester
+** itself (a cache may always recycle its own pages), or one whose owning
+** cache has more purgeable pages than the nMin Attach reserved for it, so
+** stealing it won't push that cache below the minimum it was promised.
+** It returns nil if nothing on the list is eligible, leaving the caller
+** to fall back to xStress or a fresh allocation rather than steal from a
+** foreign cache sitting at its reserved minimum.
+*/
+func (g *PGroup) findVictim(requester *PCache) *PgHdr {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  for p := g.lru.pLruPrev; p != &g.lru; p = p.pLruPrev {
+    if p.pCache == requester || p.pCache == nil || p.pCache.nPurgeable > p.pCache.nMin {
+      return p
+    }
+  }
+  return nil
+}
+
+/*
+** Truncate discards every page in cache with iKey >= iLimit, pinned or
+** not -- the caller is expected to be rolling the whole database back
+** to iLimit pages, so a cursor or transaction still holding a reference
+** above that point is about to have it invalidated anyway. A pinned
+** page's outstanding references are force-dropped from cache.nRefSum
+** before it is freed, rather than left there to inflate it forever and
+** trip a later AssertNoRefs. nPurgeable only moves if g.unlink reports the
+** page was actually on the list -- the same guard Pin uses -- since a
+** dirty-but-unreffed page discarded here may never have been linked.
+*/
+func (g *PGroup) Truncate(cache *PCache, iLimit int) {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+
+  for h := 0; h < cache.nHash; h++ {
+    pPage := cache.apHash[h]
+    for pPage != nil {
+      pNext := pPage.pNext
+      if pPage.iKey >= iLimit {
+        if pPage.nRef > 0 {
+          cache.nRefSum -= pPage.nRef
+          pPage.nRef = 0
+        }
+        if g.unlink(pPage) {
+          cache.nPurgeable--
+        }
+        cache.RemoveFromHash(pPage)
+      }
+      pPage = pNext
+    }
+  }
+}
@@ -0,0 +1,118 @@
+package bplustree
+
+import "testing"
+
+/*
+** Two PCache instances sharing a PGroup should recycle pages from each
+** other's working set: a Fetch on one cache that needs to recycle must
+** be able to steal the LRU tail even when that page belongs to a
+** sibling cache.
+*/
+func TestPGroupSharedEviction(t *testing.T) {
+  group := NewPGroup()
+
+  a := &PCache{nMax: 1}
+  b := &PCache{nMax: 1}
+  group.Attach(a)
+  group.Attach(b)
+  a.Create(64)
+  b.Create(64)
+
+  pgA := a.Fetch(1)
+  a.Unpin(pgA, true) // drop the ref but keep the page cached, landing it on the shared LRU
+
+  if group.lru.pLruPrev == &group.lru {
+    t.Fatal("expected pgA on the shared LRU list after Unpin(reuse=true)")
+  }
+
+  pgB := b.Fetch(2)
+  if pgB == nil {
+    t.Fatal("b.Fetch(2) returned nil")
+  }
+  if got := a.PageCount(); got != 0 {
+    t.Fatalf("expected b's Fetch to recycle a's page off the shared LRU, a.PageCount() = %d", got)
+  }
+}
+
+/*
+** A cache attached with a reserved nMin must not be stolen from by a
+** sibling cache while it still holds only its reserved minimum: Attach's
+** nMin/nPurgeable accounting is supposed to protect it, not just be
+** summed into nMinPage and otherwise ignored.
+*/
+func TestPGroupStealRespectsReservedMin(t *testing.T) {
+  group := NewPGroup()
+
+  a := &PCache{nMax: 1}
+  b := &PCache{nMax: 1, nMin: 1}
+  group.Attach(a)
+  group.Attach(b)
+  a.Create(64)
+  b.Create(64)
+
+  pgB := b.Fetch(1)
+  b.Unpin(pgB, true) // drop the ref but keep the page cached, at b's reserved minimum
+
+  pgA := a.Fetch(2)
+  if pgA == nil {
+    t.Fatal("a.Fetch(2) returned nil")
+  }
+  if got := b.PageCount(); got != 1 {
+    t.Fatalf("b.PageCount() = %d, want 1; a stole b's page below its reserved nMin", got)
+  }
+}
+
+/*
+** Truncate must force-drop a still-pinned page's outstanding references
+** along with it, not just unlink it from the LRU list it was never on
+** in the first place -- otherwise cache.nRefSum stays inflated by that
+** page's nRef forever and a later AssertNoRefs panics even though
+** nothing is actually still referenced.
+*/
+func TestPGroupTruncateDropsPinnedPageRefs(t *testing.T) {
+  cache := &PCache{nMax: 4}
+  cache.Create(64)
+
+  pg := cache.Fetch(5)
+  if pg.nRef != 1 {
+    t.Fatalf("nRef after Fetch = %d, want 1", pg.nRef)
+  }
+
+  cache.Truncate(5)
+
+  if cache.nRefSum != 0 {
+    t.Fatalf("nRefSum after Truncate = %d, want 0", cache.nRefSum)
+  }
+  cache.AssertNoRefs() // must not panic
+  if cache.PageCount() != 0 {
+    t.Fatalf("PageCount after Truncate = %d, want 0", cache.PageCount())
+  }
+}
+
+/*
+** Truncate must not decrement nPurgeable for a page that was never linked
+** onto the shared LRU list in the first place: a page made dirty while
+** still referenced, then Unref'd to zero, stays off the list (Unref only
+** links a clean page back on), the same case Pin/Unpin/findVictim already
+** guard against (da637be). Truncate has to check g.unlink's result the
+** same way instead of assuming every discarded, unreffed page was linked.
+*/
+func TestPGroupTruncateSkipsNPurgeableForNeverLinkedPage(t *testing.T) {
+  cache := &PCache{nMax: 4}
+  cache.Create(64)
+
+  pg := cache.Fetch(5)
+  pg.flags = PGHDR_CLEAN // ReadPage's convention for a freshly loaded page
+  cache.MakeDirty(pg)
+  cache.Unref(pg)
+
+  if cache.nPurgeable != 0 {
+    t.Fatalf("nPurgeable before Truncate = %d, want 0", cache.nPurgeable)
+  }
+
+  cache.Truncate(5)
+
+  if cache.nPurgeable != 0 {
+    t.Fatalf("nPurgeable after Truncate = %d, want 0; Truncate decremented it for a page never on the LRU", cache.nPurgeable)
+  }
+}